@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/mmlt/systemd-operator/internal/apis/nto/v1alpha1"
+	"github.com/mmlt/systemd-operator/internal/kclient"
+	"github.com/mmlt/systemd-operator/internal/operator"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The agent runs on each node, as a privileged DaemonSet, and reconciles the units of the node it runs on.
+// Unlike the operator it doesn't need SSH credentials and the work is spread over the nodes.
+// As each agent only knows about its own node, the max-unavailable annotation doesn't limit the number of nodes
+// that are updated at the same time.
+// The agent only reads the ConfigMaps, SystemdUnits and Secrets of its own namespace, see agent-ds.yaml for the RBAC
+// rules it needs. It can't patch Nodes with its own credentials, the status annotation of its node is patched with the
+// credentials of the node (see --node-kubeconfig) which can only patch the node itself.
+
+var (
+	// Version as set during build.
+	Version string
+
+	k8sApi = flag.String("k8s-api", "",
+		`URL of Kubernetes API server or "" when running in-cluster`)
+
+	nodeName = flag.String("node", os.Getenv("NODE_NAME"),
+		`Name of the node the agent runs on, defaults to the NODE_NAME environment variable`)
+
+	namespace = flag.String("namespace", os.Getenv("POD_NAMESPACE"),
+		`Namespace of the ConfigMaps, SystemdUnits and Secrets, defaults to the POD_NAMESPACE environment variable`)
+
+	nodeKubeconfig = flag.String("node-kubeconfig", "",
+		`Kubeconfig with the credentials of the node, for example /var/lib/kubelet/kubeconfig, to report the status of the node. The status isn't reported when empty.`)
+
+	nsenter = flag.Bool("nsenter", true,
+		`Run commands in the namespaces of the host, requires a privileged container with hostPID.`)
+
+	operatorId = flag.String("id", "nto",
+		`String to identify service and timer entries created by this operator. Check README before changing!`)
+
+	filePrefixes = flag.String("file-prefixes", "",
+		`Comma separated path prefixes of the files that can be installed, defaults to /usr/local/libexec/<id>/,/etc/default/<id>-`)
+
+	promAddrs = flag.String("prom-addrs", ":9102",
+		`The Prometheus endpoint address.`)
+
+	dryRun = flag.Bool("dry-run", false,
+		`Print the unit file differences and the commands that would be run instead of changing the host.`)
+
+	resync = flag.Duration("resync", time.Hour,
+		`Interval at which the node is reconciled to correct drift, 0 disables resync.`)
+)
+
+func main() {
+	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
+	pflag.Parse()
+	flag.Parse() // glog needs flag otherwise it will Prefix 'ERROR: logging before flag.Parse:' to each message.
+
+	s := fmt.Sprintf("Start unit_agent %s", Version)
+	pflag.VisitAll(func(flag *pflag.Flag) {
+		s = fmt.Sprintf("%s %s=%q", s, flag.Name, flag.Value)
+	})
+	glog.Info(s)
+
+	// Validate cli flags
+	if *operatorId == "" {
+		glog.Fatal("operator-id invalid: ", *operatorId)
+	}
+	if *nodeName == "" {
+		glog.Fatal("node name not set")
+	}
+	if *namespace == "" {
+		glog.Fatal("namespace not set")
+	}
+
+	// Start components
+	config, err := clientcmd.BuildConfigFromFlags(*k8sApi, "")
+	if err != nil {
+		glog.Fatal("k8s config err: ", err)
+	}
+
+	kubeClient := kubernetes.NewForConfigOrDie(config)
+
+	unitClient, err := v1alpha1.NewClient(config)
+	if err != nil {
+		glog.Fatal("SystemdUnit client err: ", err)
+	}
+
+	// Create client that talks to the API server.
+	c := kclient.NewForNode(kubeClient, unitClient, *operatorId, *nodeName, *namespace)
+	if *nodeKubeconfig != "" {
+		nodeConfig, err := clientcmd.BuildConfigFromFlags(*k8sApi, *nodeKubeconfig)
+		if err != nil {
+			glog.Fatal("node k8s config err: ", err)
+		}
+		c.SetStatusClient(kubernetes.NewForConfigOrDie(nodeConfig))
+	}
+	c.SetResyncPeriod(*resync)
+	c.SetWorkers(1)
+	if *dryRun {
+		c.SetDryRun()
+	}
+
+	// Create backend to modify systemd units of this host.
+	t := operator.NewLocalTransport()
+	if *nsenter {
+		t = operator.NewNsenterTransport()
+	}
+	op := operator.NewLocal(t, *operatorId, "/etc/systemd/system/", *dryRun)
+	if *filePrefixes != "" {
+		op.SetFilePrefixes(strings.Split(*filePrefixes, ","))
+	}
+
+	// Wire the components.
+	c.OnChange(op.Update)
+	op.SetRecorder(c)
+
+	// Start the instances.
+	stop := make(chan struct{})
+
+	wg := &sync.WaitGroup{} // GO routines should add themselves
+	go c.Run(stop, wg)
+
+	// Start prometheus endpoint
+	http.Handle("/metrics", promhttp.Handler())
+	err = http.ListenAndServe(*promAddrs, nil)
+	if err != http.ErrServerClosed {
+		glog.Error(err)
+	}
+
+	glog.Info("Shutting down.")
+	close(stop)
+	wg.Wait()
+}
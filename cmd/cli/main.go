@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/mmlt/systemd-operator/internal/kclient"
 	"github.com/mmlt/systemd-operator/internal/operator"
 	"github.com/spf13/pflag"
 	"gopkg.in/yaml.v2"
@@ -22,6 +23,11 @@ var (
 	sshFile = flag.String("ssh-file", "",
 		`File containing the user SSH key`)
 
+	sshKnownHosts = flag.String("ssh-known-hosts", "",
+		`known_hosts file to verify the SSH host key with`)
+	sshInsecureIgnoreHostKey = flag.Bool("ssh-insecure-ignore-host-key", false,
+		`Accept any SSH host key when ssh-known-hosts isn't set. Insecure!`)
+
 	operatorId = flag.String("id", "nto",
 		`String to identify service and timer entries created. Check README before changing!`)
 
@@ -30,6 +36,9 @@ var (
 
 	statePath = flag.String("state", "",
 		`The yaml file containing desired state.`)
+
+	dryRun = flag.Bool("dry-run", false,
+		`Print the unit file differences and the commands that would be run instead of changing the hosts.`)
 )
 
 func main() {
@@ -48,7 +57,18 @@ func main() {
 		readFileOrReturnArg(*sshPass),
 		readFileOrReturnArg(*sshFile),
 		*operatorId,
-		"/etc/systemd/system/")
+		"/etc/systemd/system/",
+		*dryRun)
+	if *sshKnownHosts != "" {
+		err := op.SetKnownHosts(*sshKnownHosts)
+		if err != nil {
+			glog.Exit("ssh-known-hosts invalid: ", err)
+		}
+	} else if *sshInsecureIgnoreHostKey {
+		op.SetInsecureIgnoreHostKey()
+	} else {
+		glog.Exit("ssh-known-hosts not set, set ssh-insecure-ignore-host-key to accept any host key")
+	}
 
 	// Read yaml
 	configYaml, err := ioutil.ReadFile(*statePath)
@@ -64,10 +84,18 @@ func main() {
 	}
 
 	// Reconcile
-	err = op.Reconcile(*host, desiredState)
+	r, err := op.Reconcile(&kclient.Node{
+		Address: *host,
+		Desired: kclient.Desired{Units: desiredState},
+	})
 	if err != nil {
 		glog.Error(err)
 	}
+	if r != nil {
+		for _, u := range r.Units {
+			glog.Infof("%s %s hash=%s err=%v", u.Name, u.Action, u.Hash, u.Err)
+		}
+	}
 
 	glog.Info("CLI completed")
 }
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/mmlt/systemd-operator/internal/apis/nto/v1alpha1"
 	"github.com/mmlt/systemd-operator/internal/kclient"
 	"github.com/mmlt/systemd-operator/internal/operator"
 	"github.com/prometheus/client_golang/prometheus"
@@ -14,6 +15,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -33,11 +35,34 @@ var (
 	sshFile = flag.String("ssh-file", "",
 		`File containing the user SSH key`)
 
+	sshKnownHosts = flag.String("ssh-known-hosts", "",
+		`known_hosts file to verify the SSH host keys of nodes with`)
+	sshHostKeySecret = flag.String("ssh-host-key-secret", "",
+		`namespace/name of the Secret in which SSH host keys are stored when a node is first seen (trust on first use)`)
+	sshInsecureIgnoreHostKey = flag.Bool("ssh-insecure-ignore-host-key", false,
+		`Accept any SSH host key of nodes without a pinned key when ssh-known-hosts and ssh-host-key-secret aren't set. Insecure!`)
+	sshIdleTimeout = flag.Duration("ssh-idle-timeout", 5*time.Minute,
+		`Time an SSH connection is kept open after a reconcile, 0 closes connections after each reconcile.`)
+	sshKeepAlive = flag.Duration("ssh-keepalive", 30*time.Second,
+		`Interval at which idle SSH connections are checked.`)
+
 	operatorId = flag.String("id", "nto",
 		`String to identify service and timer entries created by this operator. Check README before changing!`)
 
+	filePrefixes = flag.String("file-prefixes", "",
+		`Comma separated path prefixes of the files that can be installed, defaults to /usr/local/libexec/<id>/,/etc/default/<id>-`)
+
 	promAddrs = flag.String("prom-addrs", ":9102",
 		`The Prometheus endpoint address.`)
+
+	dryRun = flag.Bool("dry-run", false,
+		`Print the unit file differences and the commands that would be run instead of changing the hosts.`)
+
+	workers = flag.Int("workers", 8,
+		`Number of nodes that are reconciled in parallel.`)
+
+	resync = flag.Duration("resync", time.Hour,
+		`Interval at which all ready nodes are reconciled to correct drift, 0 disables resync.`)
 )
 
 func init() {
@@ -104,8 +129,18 @@ func main() {
 	kubeClient := kubernetes.NewForConfigOrDie(config)
 	sharedInformers := informers.NewSharedInformerFactory(kubeClient, 15*time.Minute)
 
+	unitClient, err := v1alpha1.NewClient(config)
+	if err != nil {
+		glog.Fatal("SystemdUnit client err: ", err)
+	}
+
 	// Create client that talks to the API server.
-	c := kclient.New(kubeClient, sharedInformers, *operatorId)
+	c := kclient.New(kubeClient, unitClient, sharedInformers, *operatorId)
+	c.SetResyncPeriod(*resync)
+	c.SetWorkers(*workers)
+	if *dryRun {
+		c.SetDryRun()
+	}
 
 	// Create backend to modify systemd units.
 	// TODO op := operator.New(*sshUser, *sshPass, *sshFile, *operatorId, "/etc/systemd/system/")
@@ -114,10 +149,41 @@ func main() {
 		readFileOrReturnArg(*sshPass),
 		readFileOrReturnArg(*sshFile),
 		*operatorId,
-		"/etc/systemd/system/")
+		"/etc/systemd/system/",
+		*dryRun)
+
+	op.SetPool(*sshIdleTimeout, *sshKeepAlive)
+	if *filePrefixes != "" {
+		op.SetFilePrefixes(strings.Split(*filePrefixes, ","))
+	}
+
+	// Configure host key verification, nodes can pin their key with an annotation.
+	if *sshKnownHosts != "" {
+		err = op.SetKnownHosts(*sshKnownHosts)
+		if err != nil {
+			glog.Fatal("ssh-known-hosts invalid: ", err)
+		}
+	}
+	if *sshHostKeySecret != "" {
+		p := strings.SplitN(*sshHostKeySecret, "/", 2)
+		if len(p) != 2 || p[0] == "" || p[1] == "" {
+			glog.Fatal("ssh-host-key-secret invalid: ", *sshHostKeySecret)
+		}
+		c.SetHostKeySecret(p[0], p[1])
+		op.SetHostKeyStore(c)
+	}
+	if *sshKnownHosts == "" && *sshHostKeySecret == "" {
+		if *sshInsecureIgnoreHostKey {
+			op.SetInsecureIgnoreHostKey()
+			glog.Warning("SSH host keys of nodes without a pinned key aren't verified, set ssh-known-hosts or ssh-host-key-secret")
+		} else {
+			glog.Warning("Nodes without a pinned SSH host key are refused, set ssh-known-hosts or ssh-host-key-secret")
+		}
+	}
 
 	// Wire the components.
 	c.OnChange(op.Update) //TODO rename to c.OnInstruction(b.Execute)
+	op.SetRecorder(c)
 
 	// Start the instances.
 	stop := make(chan struct{})
@@ -136,6 +202,7 @@ func main() {
 	glog.Info("Shutting down.")
 	close(stop)
 	wg.Wait()
+	op.Close()
 }
 
 // ReadFileOrReturnArg tries to read a file and return its content.
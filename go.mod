@@ -15,7 +15,6 @@ require (
 	github.com/imdario/mergo v0.0.0-20141206190957-6633656539c1
 	github.com/json-iterator/go v0.0.0-20171212105241-13f86432b882
 	github.com/matttproud/golang_protobuf_extensions v1.0.1
-	github.com/mmlt/sshclient v0.0.0
 	github.com/prometheus/client_golang v0.8.0
 	github.com/prometheus/client_model v0.0.0-20180712105110-5c3871d89910
 	github.com/prometheus/common v0.0.0-20180801064454-c7de2306084e
@@ -35,5 +34,3 @@ require (
 	k8s.io/client-go v7.0.0+incompatible
 	k8s.io/kube-openapi v0.0.0-20180216212618-50ae88d24ede
 )
-
-replace github.com/mmlt/sshclient v0.0.0 => ../sshclient
@@ -0,0 +1,4 @@
+// Package v1alpha1 contains the SystemdUnit custom resource that describes a systemd unit to be installed on Nodes.
+// +k8s:deepcopy-gen=package
+// +groupName=nto.mmlt.nl
+package v1alpha1
@@ -0,0 +1,73 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SystemdUnit describes a systemd unit file that is installed on the selected Nodes.
+type SystemdUnit struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SystemdUnitSpec   `json:"spec"`
+	Status SystemdUnitStatus `json:"status,omitempty"`
+}
+
+// SystemdUnitSpec is the desired state of a SystemdUnit.
+type SystemdUnitSpec struct {
+	// Name of the unit without type suffix, for example 'backup'.
+	Name string `json:"name"`
+	// Type of the unit; service, timer, socket, path, mount, automount or target.
+	Type string `json:"type"`
+	// Content of the unit file.
+	Content string `json:"content"`
+	// Enabled is false when the unit should be removed from the Nodes.
+	// Defaults to true.
+	Enabled *bool `json:"enabled,omitempty"`
+	// NodeSelector selects the Nodes the unit is installed on.
+	// When nil the unit is installed on all Nodes.
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+	// MaxUnavailable is the maximum number or percentage of Nodes that are updated at the same time.
+	// When nil all Nodes are updated at once.
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+	// RestartPolicy is applied when the content of an installed unit changes;
+	// none, reload, restart, try-restart or reload-or-restart.
+	// Defaults to none, the change takes effect the next time the unit starts.
+	RestartPolicy string `json:"restartPolicy,omitempty"`
+	// Instances are the instances of a template unit (a unit with a name ending in '@') that are enabled and
+	// started, for example 'a' for backup@a.service. Each item is a template that is rendered per Node and can
+	// result in zero or more space separated instances.
+	Instances []string `json:"instances,omitempty"`
+}
+
+// SystemdUnitStatus is the observed state of a SystemdUnit.
+type SystemdUnitStatus struct {
+	// ObservedGeneration is the generation of the Spec the status applies to.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Nodes are the addresses of the Nodes selected by the NodeSelector.
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+// FileName returns the systemd unit file name, for example 'backup.service'.
+func (su *SystemdUnit) FileName() string {
+	return su.Spec.Name + "." + su.Spec.Type
+}
+
+// IsEnabled returns true when the unit should be installed.
+func (su *SystemdUnit) IsEnabled() bool {
+	return su.Spec.Enabled == nil || *su.Spec.Enabled
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SystemdUnitList is a list of SystemdUnit resources.
+type SystemdUnitList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []SystemdUnit `json:"items"`
+}
@@ -0,0 +1,153 @@
+// Package diff computes the line differences between two texts.
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// context is the number of unchanged lines shown around a change.
+const context = 3
+
+// edit is a line of an edit script.
+type edit struct {
+	// kind is ' ' for an unchanged line, '-' for a deleted line and '+' for an inserted line.
+	kind byte
+	text string
+}
+
+// Unified returns the differences between text a and b in unified diff format.
+// An empty string is returned when a and b are equal.
+func Unified(aName, bName, a, b string) string {
+	edits := editScript(lines(a), lines(b))
+
+	// line numbers in a and b before each edit
+	aLine := make([]int, len(edits)+1)
+	bLine := make([]int, len(edits)+1)
+	for k, e := range edits {
+		aLine[k+1], bLine[k+1] = aLine[k], bLine[k]
+		if e.kind != '+' {
+			aLine[k+1]++
+		}
+		if e.kind != '-' {
+			bLine[k+1]++
+		}
+	}
+
+	var buf bytes.Buffer
+	k := 0
+	for k < len(edits) {
+		// find next change
+		for k < len(edits) && edits[k].kind == ' ' {
+			k++
+		}
+		if k == len(edits) {
+			break
+		}
+
+		start := k - context
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for {
+			for end < len(edits) && edits[end].kind != ' ' {
+				end++
+			}
+			e := end
+			for e < len(edits) && edits[e].kind == ' ' {
+				e++
+			}
+			if e < len(edits) && e-end <= 2*context {
+				// next change is close, add it to the hunk
+				end = e
+				continue
+			}
+			end += context
+			if end > len(edits) {
+				end = len(edits)
+			}
+			break
+		}
+
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %s\n+++ %s\n", aName, bName)
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n",
+			hunkRange(aLine[start], aLine[end]-aLine[start]),
+			hunkRange(bLine[start], bLine[end]-bLine[start]))
+		for _, e := range edits[start:end] {
+			buf.WriteByte(e.kind)
+			buf.WriteString(e.text)
+			buf.WriteByte('\n')
+		}
+
+		k = end
+	}
+
+	return buf.String()
+}
+
+// HunkRange formats the start line (0 based) and number of lines of a hunk.
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// Lines splits s in lines.
+func lines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// EditScript returns the edits that transform a into b based on the longest common subsequence of lines.
+func editScript(a, b []string) []edit {
+	n, m := len(a), len(b)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var result []edit
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			result = append(result, edit{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			result = append(result, edit{'-', a[i]})
+			i++
+		default:
+			result = append(result, edit{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		result = append(result, edit{'-', a[i]})
+	}
+	for ; j < m; j++ {
+		result = append(result, edit{'+', b[j]})
+	}
+	return result
+}
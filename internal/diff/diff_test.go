@@ -0,0 +1,100 @@
+package diff
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Numbered returns a text of n lines numbered from 1 with the lines in changes replaced.
+func numbered(n int, changes map[int]string) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		if s, ok := changes[i]; ok {
+			b.WriteString(s)
+		} else {
+			b.WriteString(strconv.Itoa(i))
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "equal",
+			a:    "x\ny\n",
+			b:    "x\ny\n",
+			want: "",
+		},
+		{
+			name: "both empty",
+			want: "",
+		},
+		{
+			name: "missing newline at end is ignored",
+			a:    "x\ny",
+			b:    "x\ny\n",
+			want: "",
+		},
+		{
+			name: "create",
+			b:    "x\ny\n",
+			want: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+x\n+y\n",
+		},
+		{
+			name: "remove",
+			a:    "x\n",
+			want: "--- a\n+++ b\n@@ -1 +0,0 @@\n-x\n",
+		},
+		{
+			name: "change with context",
+			a:    numbered(10, nil),
+			b:    numbered(10, map[int]string{5: "e"}),
+			want: "--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+e\n 6\n 7\n 8\n",
+		},
+		{
+			name: "insert at start",
+			a:    numbered(5, nil),
+			b:    "0\n" + numbered(5, nil),
+			want: "--- a\n+++ b\n@@ -1,3 +1,4 @@\n+0\n 1\n 2\n 3\n",
+		},
+		{
+			name: "delete at end",
+			a:    numbered(5, nil),
+			b:    numbered(4, nil),
+			want: "--- a\n+++ b\n@@ -2,4 +2,3 @@\n 2\n 3\n 4\n-5\n",
+		},
+		{
+			name: "close changes are merged",
+			a:    numbered(20, nil),
+			b:    numbered(20, map[int]string{3: "c", 9: "i"}),
+			want: "--- a\n+++ b\n@@ -1,12 +1,12 @@\n 1\n 2\n-3\n+c\n 4\n 5\n 6\n 7\n 8\n-9\n+i\n 10\n 11\n 12\n",
+		},
+		{
+			name: "changes with overlapping context are merged",
+			a:    numbered(12, nil),
+			b:    numbered(12, map[int]string{3: "c", 10: "j"}),
+			want: "--- a\n+++ b\n@@ -1,12 +1,12 @@\n 1\n 2\n-3\n+c\n 4\n 5\n 6\n 7\n 8\n 9\n-10\n+j\n 11\n 12\n",
+		},
+		{
+			name: "distant changes are separate hunks",
+			a:    numbered(20, nil),
+			b:    numbered(20, map[int]string{3: "c", 13: "m"}),
+			want: "--- a\n+++ b\n@@ -1,6 +1,6 @@\n 1\n 2\n-3\n+c\n 4\n 5\n 6\n" +
+				"@@ -10,7 +10,7 @@\n 10\n 11\n 12\n-13\n+m\n 14\n 15\n 16\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Unified("a", "b", tt.a, tt.b); got != tt.want {
+				t.Errorf("Unified() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
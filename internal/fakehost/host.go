@@ -0,0 +1,454 @@
+// Package fakehost simulates a host for reconcile tests that don't need a real machine.
+//
+// A Host implements the operator Transport and the systemctl Executer. It keeps an in-memory filesystem and a
+// minimal systemd; unit files are loaded by daemon-reload, enable and disable manage the symlinks in *.wants/
+// directories and start and stop change the active state of units. Only the commands that the operator runs are
+// understood, an unknown command fails with exit status 127.
+package fakehost
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SystemDir is the directory of the unit files.
+const SystemDir = "/etc/systemd/system"
+
+// Host is a simulated host.
+type Host struct {
+	mu sync.Mutex
+	// files by absolute path.
+	files map[string]*File
+	// dirs contains the directories that exist besides the parents of files.
+	dirs map[string]bool
+	// units contains the units that are loaded by daemon-reload by unit file name.
+	units map[string]*unit
+	// fail contains the command prefixes that fail.
+	fail []string
+	// log contains the commands that have been run.
+	log []string
+}
+
+// File is a file or symlink of a Host.
+type File struct {
+	Data  string
+	Mode  os.FileMode
+	Owner string
+	// Link is the target of a symlink or "" for a regular file.
+	Link string
+}
+
+// New returns a host with an empty SystemDir.
+func New() *Host {
+	return &Host{
+		files: make(map[string]*File),
+		dirs:  map[string]bool{"/": true, SystemDir: true, "/var/tmp": true},
+		units: make(map[string]*unit),
+	}
+}
+
+// FailOn makes the commands that start with prefix fail with exit status 1, for example
+// 'systemctl start nto-x.service' or 'systemd-analyze verify'. The 'sudo' of a command isn't part of the match.
+// WriteFile and ReadFile are the commands 'write <path>' and 'read <path>'.
+func (h *Host) FailOn(prefix string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fail = append(h.fail, prefix)
+}
+
+// Commands returns the commands that have been run.
+func (h *Host) Commands() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.log...)
+}
+
+// File returns the file at path.
+func (h *Host) File(path string) (File, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, ok := h.files[path]
+	if !ok {
+		return File{}, false
+	}
+	return *f, true
+}
+
+// Paths returns the sorted paths of the files that match pattern, see path.Match.
+func (h *Host) Paths(pattern string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.glob(pattern)
+}
+
+// SetFile creates or replaces a regular file owned by root:root.
+func (h *Host) SetFile(path, data string, mode os.FileMode) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.files[path] = &File{Data: data, Mode: mode, Owner: "root:root"}
+}
+
+// Exec runs a command.
+// Arguments are interpreted like a shell does; globs are expanded and single quotes are removed.
+func (h *Host) Exec(cmd string, args ...string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if cmd == "sudo" && len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	err := h.record(strings.Join(append([]string{cmd}, args...), " "))
+	if err != nil {
+		return "", err
+	}
+
+	var words []string
+	for _, a := range args {
+		words = append(words, h.expand(a)...)
+	}
+
+	switch cmd {
+	case "true":
+		return "", nil
+	case "cat":
+		return h.cat(words)
+	case "test":
+		return h.test(words)
+	case "sha1sum":
+		return h.sha1sum(words)
+	case "ls":
+		return h.ls(words)
+	case "mkdir":
+		return h.mkdir(words)
+	case "rmdir":
+		return h.rmdir(words)
+	case "rm":
+		return h.rm(words)
+	case "mv":
+		return h.mv(words)
+	case "cp":
+		return h.cp(words)
+	case "chown":
+		return h.chown(words)
+	case "chmod":
+		return h.chmod(words)
+	case "systemctl":
+		return h.systemctl(words)
+	case "systemd-analyze":
+		return h.systemdAnalyze(words)
+	}
+	return "", exitError(127, cmd+": command not found")
+}
+
+// WriteFile replaces the file at path.
+func (h *Host) WriteFile(path string, data []byte, mode os.FileMode) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.record("write " + path)
+	if err != nil {
+		return err
+	}
+	if !h.isDir(dir(path)) {
+		return fmt.Errorf("write %s: no such directory", path)
+	}
+	h.files[path] = &File{Data: string(data), Mode: mode, Owner: "root:root"}
+	return nil
+}
+
+// ReadFile returns the content of the file at path.
+func (h *Host) ReadFile(path string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.record("read " + path)
+	if err != nil {
+		return "", err
+	}
+	f, ok := h.files[path]
+	if !ok {
+		return "", &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
+	}
+	return f.Data, nil
+}
+
+// RemoveFile removes the file at path.
+func (h *Host) RemoveFile(path string) error {
+	_, err := h.Exec("rm", "-f", path)
+	return err
+}
+
+// Close does nothing.
+func (h *Host) Close() {
+}
+
+// Record adds a command to the log and returns an error when the command must fail.
+func (h *Host) record(line string) error {
+	h.log = append(h.log, line)
+	for _, p := range h.fail {
+		if strings.HasPrefix(line, p) {
+			return exitError(1, "injected failure")
+		}
+	}
+	return nil
+}
+
+// ExitError returns an error like the one of a command that exits with code.
+func exitError(code int, msg string) error {
+	return &exitStatusError{msg, code}
+}
+
+// ExitStatusError is the error of a command that ran and exited with a non-zero status.
+type exitStatusError struct {
+	msg    string
+	status int
+}
+
+func (e *exitStatusError) Error() string {
+	return fmt.Sprintf("%s: Process exited with status %d", e.msg, e.status)
+}
+
+// ExitStatus returns the exit status of the command.
+func (e *exitStatusError) ExitStatus() int {
+	return e.status
+}
+
+// Expand returns the paths that match a glob or the argument without quotes.
+func (h *Host) expand(arg string) []string {
+	if strings.HasPrefix(arg, "'") && strings.HasSuffix(arg, "'") && len(arg) > 1 {
+		return []string{strings.Replace(arg[1:len(arg)-1], `'\''`, "'", -1)}
+	}
+	if !strings.ContainsAny(arg, "*?[") {
+		return []string{arg}
+	}
+	m := h.glob(arg)
+	if len(m) == 0 {
+		// like a shell, a glob that doesn't match is passed as is
+		return []string{arg}
+	}
+	return m
+}
+
+// Glob returns the sorted paths of files that match pattern.
+func (h *Host) glob(pattern string) []string {
+	var result []string
+	for p := range h.files {
+		if ok, _ := path.Match(pattern, p); ok {
+			result = append(result, p)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Dir returns the directory of a path.
+func dir(p string) string {
+	return path.Dir(path.Clean(p))
+}
+
+// IsDir returns true when p is a directory.
+func (h *Host) isDir(p string) bool {
+	p = path.Clean(p)
+	if h.dirs[p] {
+		return true
+	}
+	for f := range h.files {
+		if strings.HasPrefix(f, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Split returns the flags and operands of a command.
+func split(words []string) (flags map[string]bool, operands []string) {
+	flags = make(map[string]bool)
+	for _, w := range words {
+		if strings.HasPrefix(w, "-") {
+			flags[w] = true
+			continue
+		}
+		operands = append(operands, w)
+	}
+	return flags, operands
+}
+
+func (h *Host) cat(words []string) (string, error) {
+	var b strings.Builder
+	for _, p := range words {
+		f, ok := h.files[p]
+		if !ok {
+			return b.String(), exitError(1, "cat: "+p+": No such file or directory")
+		}
+		b.WriteString(f.Data)
+	}
+	return b.String(), nil
+}
+
+func (h *Host) test(words []string) (string, error) {
+	if len(words) != 2 || words[0] != "-e" {
+		return "", exitError(2, "test: unsupported expression")
+	}
+	if _, ok := h.files[words[1]]; ok || h.isDir(words[1]) {
+		return "", nil
+	}
+	return "", exitError(1, "")
+}
+
+func (h *Host) sha1sum(words []string) (string, error) {
+	var b strings.Builder
+	var err error
+	for _, p := range words {
+		f, ok := h.files[p]
+		if !ok {
+			err = exitError(1, "sha1sum: "+p+": No such file or directory")
+			continue
+		}
+		fmt.Fprintf(&b, "%x  %s\n", sha1.Sum([]byte(f.Data)), p)
+	}
+	return b.String(), err
+}
+
+func (h *Host) ls(words []string) (string, error) {
+	_, operands := split(words)
+	var b strings.Builder
+	var err error
+	for _, p := range operands {
+		if _, ok := h.files[p]; !ok {
+			err = exitError(2, "ls: cannot access '"+p+"': No such file or directory")
+			continue
+		}
+		fmt.Fprintln(&b, p)
+	}
+	return b.String(), err
+}
+
+func (h *Host) mkdir(words []string) (string, error) {
+	flags, operands := split(words)
+	for _, p := range operands {
+		p = path.Clean(p)
+		if !flags["-p"] && !h.isDir(dir(p)) {
+			return "", exitError(1, "mkdir: cannot create directory '"+p+"': No such file or directory")
+		}
+		for ; p != "/"; p = dir(p) {
+			h.dirs[p] = true
+		}
+	}
+	return "", nil
+}
+
+func (h *Host) rmdir(words []string) (string, error) {
+	flags, operands := split(words)
+	for _, p := range operands {
+		p = path.Clean(p)
+		if len(h.glob(p+"/*")) > 0 {
+			if flags["--ignore-fail-on-non-empty"] {
+				continue
+			}
+			return "", exitError(1, "rmdir: failed to remove '"+p+"': Directory not empty")
+		}
+		delete(h.dirs, p)
+	}
+	return "", nil
+}
+
+func (h *Host) rm(words []string) (string, error) {
+	flags, operands := split(words)
+	for _, p := range operands {
+		p = path.Clean(p)
+		if _, ok := h.files[p]; ok {
+			delete(h.files, p)
+			continue
+		}
+		if h.isDir(p) && (flags["-rf"] || flags["-r"]) {
+			for f := range h.files {
+				if strings.HasPrefix(f, p+"/") {
+					delete(h.files, f)
+				}
+			}
+			for d := range h.dirs {
+				if d == p || strings.HasPrefix(d, p+"/") {
+					delete(h.dirs, d)
+				}
+			}
+			continue
+		}
+		if !flags["-f"] && !flags["-rf"] {
+			return "", exitError(1, "rm: cannot remove '"+p+"': No such file or directory")
+		}
+	}
+	return "", nil
+}
+
+func (h *Host) mv(words []string) (string, error) {
+	_, operands := split(words)
+	if len(operands) != 2 {
+		return "", exitError(1, "mv: expected source and destination")
+	}
+	src, dst := operands[0], operands[1]
+	f, ok := h.files[src]
+	if !ok {
+		return "", exitError(1, "mv: cannot stat '"+src+"': No such file or directory")
+	}
+	if !h.isDir(dir(dst)) {
+		return "", exitError(1, "mv: cannot move '"+src+"' to '"+dst+"': No such file or directory")
+	}
+	delete(h.files, src)
+	h.files[dst] = f
+	return "", nil
+}
+
+func (h *Host) cp(words []string) (string, error) {
+	flags, operands := split(words)
+	if len(operands) != 2 {
+		return "", exitError(1, "cp: expected source and destination")
+	}
+	src, dst := operands[0], operands[1]
+	f, ok := h.files[src]
+	if !ok {
+		return "", exitError(1, "cp: cannot stat '"+src+"': No such file or directory")
+	}
+	if !h.isDir(dir(dst)) {
+		return "", exitError(1, "cp: cannot create regular file '"+dst+"': No such file or directory")
+	}
+	c := *f
+	if !flags["-p"] {
+		c.Owner = "root:root"
+	}
+	h.files[dst] = &c
+	return "", nil
+}
+
+func (h *Host) chown(words []string) (string, error) {
+	_, operands := split(words)
+	if len(operands) != 2 {
+		return "", exitError(1, "chown: expected owner and file")
+	}
+	f, ok := h.files[operands[1]]
+	if !ok {
+		return "", exitError(1, "chown: cannot access '"+operands[1]+"': No such file or directory")
+	}
+	f.Owner = operands[0]
+	return "", nil
+}
+
+func (h *Host) chmod(words []string) (string, error) {
+	_, operands := split(words)
+	if len(operands) != 2 {
+		return "", exitError(1, "chmod: expected mode and file")
+	}
+	m, err := strconv.ParseUint(operands[0], 8, 32)
+	if err != nil {
+		return "", exitError(1, "chmod: invalid mode: '"+operands[0]+"'")
+	}
+	f, ok := h.files[operands[1]]
+	if !ok {
+		return "", exitError(1, "chmod: cannot access '"+operands[1]+"': No such file or directory")
+	}
+	f.Mode = os.FileMode(m)
+	return "", nil
+}
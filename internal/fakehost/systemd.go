@@ -0,0 +1,323 @@
+package fakehost
+
+import (
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/unitfile"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Unit is a unit that's loaded by daemon-reload.
+type unit struct {
+	file *unitfile.File
+	// active is the active state; active, inactive or failed.
+	active string
+}
+
+// ActiveState returns the active state of unit name, a unit that isn't loaded is inactive.
+func (h *Host) ActiveState(name string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if u, ok := h.units[name]; ok {
+		return u.active
+	}
+	return "inactive"
+}
+
+// Enabled returns true when unit name is enabled.
+func (h *Host) Enabled(name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.links(name)) > 0
+}
+
+// Links returns the paths of the symlinks of unit name in *.wants/ and *.requires/ directories.
+func (h *Host) links(name string) []string {
+	return append(h.glob(path.Join(SystemDir, "*.wants", name)), h.glob(path.Join(SystemDir, "*.requires", name))...)
+}
+
+// UnitFile returns the name of the file of unit name, for an instance that's the file of its template.
+func unitFile(name string) string {
+	i := strings.Index(name, "@")
+	if i < 0 {
+		return name
+	}
+	return name[:i+1] + path.Ext(name)
+}
+
+func (h *Host) systemctl(words []string) (string, error) {
+	_, operands := split(words)
+	if len(operands) == 0 {
+		return "", exitError(1, "systemctl: missing verb")
+	}
+	verb, operands := operands[0], operands[1:]
+	if verb == "daemon-reload" {
+		return h.daemonReload()
+	}
+	if len(operands) != 1 {
+		return "", exitError(1, "systemctl "+verb+": expected one unit")
+	}
+	name := operands[0]
+
+	switch verb {
+	case "list-units":
+		return h.listUnits(name), nil
+	case "list-timers":
+		return h.listTimers(name), nil
+	case "enable":
+		return h.enable(name)
+	case "disable":
+		return h.disable(name)
+	}
+
+	if strings.Contains(name, "@.") {
+		return "", exitError(1, fmt.Sprintf("Failed to %s %s: Unit name %s is missing the instance name.", verb, name, name))
+	}
+	u, ok := h.units[name]
+	if t, found := h.units[unitFile(name)]; !ok && found {
+		// first use of an instance of a loaded template
+		u = &unit{file: t.file, active: "inactive"}
+		h.units[name] = u
+	}
+	if u == nil {
+		if verb == "stop" {
+			return "", exitError(5, fmt.Sprintf("Failed to stop %s: Unit %s not loaded.", name, name))
+		}
+		return "", exitError(5, fmt.Sprintf("Failed to %s %s: Unit %s not found.", verb, name, name))
+	}
+
+	switch verb {
+	case "start", "restart", "reload-or-restart":
+		u.active = started(u.file)
+	case "try-restart":
+		if u.active == "active" {
+			u.active = started(u.file)
+		}
+	case "reload":
+		if u.active != "active" {
+			return "", exitError(1, fmt.Sprintf("Job for %s failed, unit is not active.", name))
+		}
+	case "stop":
+		u.active = "inactive"
+	default:
+		return "", exitError(1, "systemctl: unknown verb "+verb)
+	}
+	return "", nil
+}
+
+// Started returns the active state of a unit after it's started.
+// A oneshot service without RemainAfterExit has finished and is inactive.
+func started(f *unitfile.File) string {
+	s := f.Section("Service")
+	if s == nil {
+		return "active"
+	}
+	if t := s.Values("Type"); len(t) > 0 && t[len(t)-1] == "oneshot" {
+		r := s.Values("RemainAfterExit")
+		if len(r) == 0 || r[len(r)-1] != "yes" {
+			return "inactive"
+		}
+	}
+	return "active"
+}
+
+// DaemonReload (re)loads the unit files in SystemDir, units that are loaded keep their active state.
+func (h *Host) daemonReload() (string, error) {
+	units := make(map[string]*unit)
+	for _, p := range h.glob(path.Join(SystemDir, "*")) {
+		if h.files[p].Link != "" {
+			continue
+		}
+		name := path.Base(p)
+		content := h.files[p].Data
+		// drop-ins are appended to the unit
+		for _, d := range h.glob(path.Join(SystemDir, name+".d", "*.conf")) {
+			content += "\n" + h.files[d].Data
+		}
+		f, err := unitfile.Parse(strings.NewReader(content))
+		if err != nil {
+			return "", exitError(1, fmt.Sprintf("%s: %v", p, err))
+		}
+		units[name] = &unit{file: f, active: "inactive"}
+	}
+	for name, u := range h.units {
+		if t, ok := units[unitFile(name)]; ok {
+			units[name] = &unit{file: t.file, active: u.active}
+		}
+	}
+	h.units = units
+	return "", nil
+}
+
+// Enable creates the symlinks of the WantedBy= and RequiredBy= targets of a unit.
+func (h *Host) enable(name string) (string, error) {
+	if strings.Contains(name, "@.") {
+		return "", exitError(1, "Failed to enable unit: "+name+" is a template without instance")
+	}
+	fn := path.Join(SystemDir, unitFile(name))
+	f, ok := h.files[fn]
+	if !ok {
+		return "", exitError(1, "Failed to enable unit: Unit file "+name+" does not exist.")
+	}
+	uf, err := unitfile.Parse(strings.NewReader(f.Data))
+	if err != nil {
+		return "", exitError(1, fmt.Sprintf("Failed to enable unit: %v", err))
+	}
+	install := uf.Section("Install")
+	if install == nil {
+		return "The unit files have no installation config.\n", nil
+	}
+	var b strings.Builder
+	for _, kd := range [][2]string{{"WantedBy", ".wants"}, {"RequiredBy", ".requires"}} {
+		for _, v := range install.Values(kd[0]) {
+			for _, target := range strings.Fields(v) {
+				l := path.Join(SystemDir, target+kd[1], name)
+				h.files[l] = &File{Mode: 0777, Owner: "root:root", Link: fn}
+				fmt.Fprintf(&b, "Created symlink %s → %s.\n", l, fn)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// Disable removes the symlinks of a unit.
+func (h *Host) disable(name string) (string, error) {
+	if _, ok := h.files[path.Join(SystemDir, unitFile(name))]; !ok {
+		return "", exitError(1, "Failed to disable unit: Unit file "+name+" does not exist.")
+	}
+	var b strings.Builder
+	for _, l := range h.links(name) {
+		delete(h.files, l)
+		fmt.Fprintf(&b, "Removed %s.\n", l)
+	}
+	return b.String(), nil
+}
+
+// ListUnits returns the loaded units that match pattern and are active or failed, in the format of
+// 'systemctl list-units --plain --full'.
+func (h *Host) listUnits(pattern string) string {
+	var rows [][]string
+	for _, name := range h.unitNames(pattern) {
+		u := h.units[name]
+		if u.active == "inactive" {
+			continue
+		}
+		sub := map[string]string{"active": "running", "failed": "failed"}[u.active]
+		switch path.Ext(name) {
+		case ".timer", ".path":
+			sub = "waiting"
+		case ".socket":
+			sub = "listening"
+		case ".mount", ".automount":
+			sub = "mounted"
+		}
+		desc := name
+		if s := u.file.Section("Unit"); s != nil {
+			if d := s.Values("Description"); len(d) > 0 {
+				desc = d[len(d)-1]
+			}
+		}
+		rows = append(rows, []string{name, "loaded", u.active, sub, desc})
+	}
+	if len(rows) == 0 {
+		return "0 loaded units listed. Pass --all to see loaded but inactive units, too.\n"
+	}
+	return table([]string{"UNIT", "LOAD", "ACTIVE", "SUB", "DESCRIPTION"}, rows) +
+		"\nLOAD   = Reflects whether the unit definition was properly loaded.\n" +
+		"ACTIVE = The high-level unit activation state, i.e. generalization of SUB.\n" +
+		"SUB    = The low-level unit activation state, values depend on unit type.\n\n" +
+		fmt.Sprintf("%d loaded units listed.\n", len(rows))
+}
+
+// ListTimers returns the active timers that match pattern, in the format of 'systemctl list-timers --plain --full'.
+// The fake host has no clock, times are n/a.
+func (h *Host) listTimers(pattern string) string {
+	var rows [][]string
+	for _, name := range h.unitNames(pattern) {
+		if path.Ext(name) != ".timer" || h.units[name].active != "active" {
+			continue
+		}
+		activates := strings.TrimSuffix(name, ".timer") + ".service"
+		if s := h.units[name].file.Section("Timer"); s != nil {
+			if u := s.Values("Unit"); len(u) > 0 {
+				activates = u[len(u)-1]
+			}
+		}
+		rows = append(rows, []string{"n/a", "n/a", "n/a", "n/a", name, activates})
+	}
+	if len(rows) == 0 {
+		return "0 timers listed.\n"
+	}
+	return table([]string{"NEXT", "LEFT", "LAST", "PASSED", "UNIT", "ACTIVATES"}, rows) +
+		fmt.Sprintf("\n%d timers listed.\n", len(rows))
+}
+
+// UnitNames returns the sorted names of the loaded units that match pattern, templates are left out.
+func (h *Host) unitNames(pattern string) []string {
+	var result []string
+	for name := range h.units {
+		if strings.Contains(name, "@.") {
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Table returns rows as text with aligned columns.
+func table(header []string, rows [][]string) string {
+	width := make([]int, len(header))
+	for _, r := range append([][]string{header}, rows...) {
+		for i, c := range r {
+			if len(c) > width[i] {
+				width[i] = len(c)
+			}
+		}
+	}
+	var b strings.Builder
+	for _, r := range append([][]string{header}, rows...) {
+		for i, c := range r {
+			if i == len(r)-1 {
+				fmt.Fprintln(&b, c)
+				break
+			}
+			fmt.Fprintf(&b, "%-*s ", width[i], c)
+		}
+	}
+	return b.String()
+}
+
+func (h *Host) systemdAnalyze(words []string) (string, error) {
+	if len(words) == 0 {
+		return "", exitError(1, "systemd-analyze: missing verb")
+	}
+	switch words[0] {
+	case "verify":
+		var b strings.Builder
+		for _, p := range words[1:] {
+			f, ok := h.files[p]
+			if !ok {
+				fmt.Fprintf(&b, "Failed to prepare filename %s: No such file or directory\n", p)
+				continue
+			}
+			err := unitfile.ParseAndValidate(f.Data, strings.TrimPrefix(path.Ext(p), "."))
+			if err != nil {
+				fmt.Fprintf(&b, "%s: %v\n", p, err)
+			}
+		}
+		if b.Len() > 0 {
+			return b.String(), exitError(1, "")
+		}
+		return "", nil
+	case "calendar":
+		if len(words) != 2 || strings.TrimSpace(words[1]) == "" {
+			return "Failed to parse calendar specification\n", exitError(1, "")
+		}
+		return "  Original form: " + words[1] + "\n", nil
+	}
+	return "", exitError(1, "systemd-analyze: unknown verb "+words[0])
+}
@@ -3,8 +3,9 @@ package kclient
 
 
 // Package kclient is responsible for maintaining 'desired state' of the operator.
-// It watches the Kubernetes API Server for changes in ConfigMaps and Nodes and updates it's Nodes and Timers
+// It watches the Kubernetes API Server for changes in ConfigMaps, SystemdUnits and Nodes and updates it's Nodes and Timers
 // data structure accordingly.
+// Unit content is a text/template that is rendered per Node, see template.go
 // On changes it enqueues an OpCode to be performed by the backend.
 
 
@@ -0,0 +1,62 @@
+package kclient
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The SSH host keys that are trusted on first use are stored in a Secret, one data item per node name.
+// To trust a new key of a node remove its data item.
+
+// SetHostKeySecret sets the Secret in which host keys are stored.
+func (kc *kclient) SetHostKeySecret(namespace, name string) {
+	kc.hostKeyNamespace = namespace
+	kc.hostKeySecret = name
+}
+
+// HostKey returns the stored host key of node or "" when the node has no stored key.
+func (kc *kclient) HostKey(node string) (string, error) {
+	s, err := kc.client.CoreV1().Secrets(kc.hostKeyNamespace).Get(kc.hostKeySecret, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(s.Data[node]), nil
+}
+
+// SetHostKey stores the host key of node.
+// The Secret is created when it doesn't exist.
+func (kc *kclient) SetHostKey(node, key string) error {
+	kc.hostKeyMu.Lock()
+	defer kc.hostKeyMu.Unlock()
+
+	secrets := kc.client.CoreV1().Secrets(kc.hostKeyNamespace)
+	s, err := secrets.Get(kc.hostKeySecret, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = secrets.Create(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      kc.hostKeySecret,
+				Namespace: kc.hostKeyNamespace,
+			},
+			Data: map[string][]byte{node: []byte(key)},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if v, ok := s.Data[node]; ok && string(v) != key {
+		return fmt.Errorf("secret %s/%s already has a key for %s", kc.hostKeyNamespace, kc.hostKeySecret, node)
+	}
+	s = s.DeepCopy()
+	if s.Data == nil {
+		s.Data = make(map[string][]byte)
+	}
+	s.Data[node] = []byte(key)
+	_, err = secrets.Update(s)
+	return err
+}
@@ -13,6 +13,8 @@ const (
 	Update
 	Delete
 	Idle
+	// Resync is a periodic reconcile of a node to detect and correct drift.
+	Resync
 )
 
 // Instruction detected by API Server client.
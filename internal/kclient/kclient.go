@@ -1,38 +1,80 @@
 package kclient
 
 import (
+	"fmt"
 	"github.com/golang/glog"
+	"github.com/mmlt/systemd-operator/internal/apis/nto/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
-	"strings"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 )
 
-// Controller watches Kubernetes ConfigMaps and Nodes resources.
+// Controller watches Kubernetes ConfigMaps, SystemdUnits and Nodes resources.
 type kclient struct {
 	// operatorId is a string that is added to systemd unit names so they can be identified as managed by this operator.
 	operatorId string
 	// Client for the k8s API Server
 	client kubernetes.Interface
+	// unitClient is the client for SystemdUnit resources.
+	unitClient rest.Interface
+	// statusClient patches the status annotation of Nodes or is nil when the status isn't reported, see SetStatusClient.
+	statusClient kubernetes.Interface
 	// Recorder to provide user feedback via Events.
 	recorder record.EventRecorder
 	// *StoreSynced func returns true when configMapStore is in sync with the API Server.
 	configMapStoreSynced cache.InformerSynced
 	nodeStoreSynced      cache.InformerSynced
+	unitStoreSynced      cache.InformerSynced
+	secretStoreSynced    cache.InformerSynced
+
+	// secretLister gets the Secrets that are referenced by files.
+	secretLister corelisters.SecretLister
+	// unitInformer watches SystemdUnit resources.
+	unitInformer cache.SharedIndexInformer
+	// factories are the informer factories that are started by Run, see NewForNode.
+	factories []informers.SharedInformerFactory
+
+	// resyncPeriod is the interval at which all ready nodes are reconciled, 0 disables resync.
+	resyncPeriod time.Duration
+
+	// nodeName is the name of the only node that is watched or "" to watch all nodes.
+	nodeName string
+
+	// dryRun is true when nothing is written to the cluster.
+	dryRun bool
+
+	// hostKeyNamespace and hostKeySecret name the Secret with the SSH host keys that are trusted on first use.
+	hostKeyNamespace, hostKeySecret string
+	// hostKeyMu serializes updates of the host key Secret.
+	hostKeyMu sync.Mutex
 
 	// changes is a worker queue that buffers the changes before they are send to the back-end via the OnChange supplied function.
 	changes *changeQueue
 
+	// mu protects nodes, unitSets, rollouts and the fields of the nodes.
+	// The informer event handlers and the queue workers run in different go routines.
+	mu sync.Mutex
 	// nodes contains the nodes found in the cluster.
 	nodes map[string]*Node
-	// units
-	units map[string]string
+	// unitSets contains the units of each labelled ConfigMap and SystemdUnit by kind/namespace/name.
+	unitSets map[string]*unitSet
+	// rollouts contains the rollouts in progress by unitSets key.
+	rollouts map[string]*rollout
 }
 
 // StoreToConfigMapLister makes a Store that lists ConfigMap.
@@ -46,10 +88,99 @@ const (
 	// configLabelKey and Value are used to select the ConfigMaps seen by this controller.
 	configLabelKey   = "operator"
 	configLabelValue = "nto"
+	// nodeSelectorAnnotation is the ConfigMap annotation with the label selector that selects the nodes the units
+	// are installed on, for example 'kubernetes.io/role=node,!nvidia.com/gpu'.
+	nodeSelectorAnnotation = "nto.mmlt.nl/node-selector"
+	// restartPolicyAnnotation is the ConfigMap annotation with the restart policies of the units in the form
+	// <unit>=<policy>[,<unit>=<policy>...], for example 'kubelet.service.d_limits.conf=try-restart'.
+	// Policy is one of none, reload, restart, try-restart or reload-or-restart.
+	restartPolicyAnnotation = "nto.mmlt.nl/restart-policy"
+	// dropInSep separates the unit name from the drop-in name in the name of a drop-in, see operator.
+	dropInSep = ".d_"
+	// paramsAnnotation is the ConfigMap annotation with a JSON object of parameters that are available to the unit
+	// templates as .Params, for example '{"level": "debug"}'.
+	paramsAnnotation = "nto.mmlt.nl/params"
+	// instancesAnnotation is the ConfigMap annotation with a JSON object that maps a template unit to its instances,
+	// for example '{"backup@.service": "home {{index .Node.Labels \"backup\"}}"}'.
+	// The instances are a template that's rendered per node and result in a space separated list of names.
+	instancesAnnotation = "nto.mmlt.nl/instances"
+	// filesAnnotation is the ConfigMap annotation with a JSON object that declares which data items are files instead
+	// of units, for example '{"backup.sh": {"path": "/usr/local/libexec/nto/backup.sh", "mode": "0755",
+	// "units": ["backup.service"]}}'. Mode defaults to 0644, owner to root:root. The path must start with a file prefix
+	// of the operator, by default /usr/local/libexec/<id>/ or /etc/default/<id>-.
+	// A file with "secret": "<name>" instead of a data item is an EnvironmentFile with the data of that Secret in
+	// the namespace of the ConfigMap, it's owned by root:root with mode 0600. Only Secrets with the
+	// configLabelKey=configLabelValue label are watched and can be referenced.
+	filesAnnotation = "nto.mmlt.nl/files"
+	// hostKeyAnnotation is the Node annotation with the pinned SSH host key of the node in authorized_keys format,
+	// for example 'ssh-ed25519 AAAAC3Nza...', or as SHA256 fingerprint, for example 'SHA256:nThbg6kX...'.
+	hostKeyAnnotation = "nto.mmlt.nl/ssh-host-key"
+	// maxUnavailableAnnotation is the ConfigMap annotation with the maximum number or percentage of nodes that are
+	// updated at the same time when the ConfigMap changes, for example '1' or '25%'. Defaults to all nodes.
+	maxUnavailableAnnotation = "nto.mmlt.nl/max-unavailable"
+	// unitResyncPeriod is the interval at which all SystemdUnits are resend to the event handlers.
+	unitResyncPeriod = 15 * time.Minute
+	// informerResyncPeriod is the interval at which the informers created by NewForNode resend all resources.
+	informerResyncPeriod = 15 * time.Minute
 )
 
-// New creates an API server client and subscribes to resource changes.
-func New(kubeclientset kubernetes.Interface, sharedInformers informers.SharedInformerFactory, operatorId string) *kclient {
+// New creates an API server client and subscribes to resource changes in all namespaces.
+// Only the labelled Secrets are watched, the Secrets that aren't referenced by files aren't cached. The Secret
+// informer is started by Run.
+func New(kubeclientset kubernetes.Interface, unitClient rest.Interface, sharedInformers informers.SharedInformerFactory, operatorId string) *kclient {
+	secretInformers := newSecretInformerFactory(kubeclientset, metav1.NamespaceAll)
+	c := newClient(kubeclientset, unitClient,
+		sharedInformers.Core().V1().ConfigMaps(),
+		sharedInformers.Core().V1().Nodes(),
+		secretInformers.Core().V1().Secrets(),
+		metav1.NamespaceAll, operatorId)
+	c.factories = []informers.SharedInformerFactory{secretInformers}
+	return c
+}
+
+// NewForNode creates an API server client for an agent that reconciles the node with nodeName.
+// Only the k8s Node with nodeName and the ConfigMaps, SystemdUnits and Secrets in namespace are watched, so a
+// compromised node can't read the Secrets of other namespaces. The informers are started by Run.
+// The status annotation of the Node isn't patched with the credentials of the agent, as these would allow patching
+// any Node, use SetStatusClient to report the status with the credentials of the node.
+func NewForNode(kubeclientset kubernetes.Interface, unitClient rest.Interface, operatorId, nodeName, namespace string) *kclient {
+	nodeInformers := informers.NewFilteredSharedInformerFactory(kubeclientset, informerResyncPeriod, metav1.NamespaceAll,
+		func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("metadata.name", nodeName).String()
+		})
+	configMapInformers := informers.NewFilteredSharedInformerFactory(kubeclientset, informerResyncPeriod, namespace,
+		func(o *metav1.ListOptions) {
+			o.LabelSelector = labels.Set{configLabelKey: configLabelValue}.String()
+		})
+	secretInformers := newSecretInformerFactory(kubeclientset, namespace)
+
+	c := newClient(kubeclientset, unitClient,
+		configMapInformers.Core().V1().ConfigMaps(),
+		nodeInformers.Core().V1().Nodes(),
+		secretInformers.Core().V1().Secrets(),
+		namespace, operatorId)
+	c.factories = []informers.SharedInformerFactory{nodeInformers, configMapInformers, secretInformers}
+	c.SelectNode(nodeName)
+	c.SetStatusClient(nil)
+	return c
+}
+
+// NewSecretInformerFactory returns an informer factory for the Secrets in namespace with the
+// configLabelKey=configLabelValue label.
+func newSecretInformerFactory(kubeclientset kubernetes.Interface, namespace string) informers.SharedInformerFactory {
+	return informers.NewFilteredSharedInformerFactory(kubeclientset, informerResyncPeriod, namespace,
+		func(o *metav1.ListOptions) {
+			o.LabelSelector = labels.Set{configLabelKey: configLabelValue}.String()
+		})
+}
+
+// NewClient creates an API server client that subscribes to the changes of the informers and the SystemdUnits in
+// namespace.
+func newClient(kubeclientset kubernetes.Interface, unitClient rest.Interface, configMapInformer coreinformers.ConfigMapInformer,
+	nodeInformer coreinformers.NodeInformer, secretInformer coreinformers.SecretInformer, namespace, operatorId string) *kclient {
+	// make SystemdUnits known to the event recorder
+	v1alpha1.AddToScheme(scheme.Scheme)
+
 	// create event recorder
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(glog.Infof)
@@ -57,22 +188,41 @@ func New(kubeclientset kubernetes.Interface, sharedInformers informers.SharedInf
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: operatorName})
 
 	// create informers
-	configMapInformer := sharedInformers.Core().V1().ConfigMaps()
-	nodeInformer := sharedInformers.Core().V1().Nodes()
+	unitInformer := cache.NewSharedIndexInformer(
+		cache.NewListWatchFromClient(unitClient, v1alpha1.ResourcePlural, namespace, fields.Everything()),
+		&v1alpha1.SystemdUnit{},
+		unitResyncPeriod,
+		cache.Indexers{},
+	)
 
 	c := kclient{
 		operatorId:           operatorId,
 		client:               kubeclientset,
+		unitClient:           unitClient,
+		statusClient:         kubeclientset,
 		recorder:             recorder,
 		configMapStoreSynced: configMapInformer.Informer().HasSynced,
 		nodeStoreSynced:      nodeInformer.Informer().HasSynced,
+		unitStoreSynced:      unitInformer.HasSynced,
+		secretStoreSynced:    secretInformer.Informer().HasSynced,
+		secretLister:         secretInformer.Lister(),
+		unitInformer:         unitInformer,
 
-		nodes: make(map[string]*Node),
-		units: make(map[string]string),
+		nodes:    make(map[string]*Node),
+		unitSets: make(map[string]*unitSet),
+		rollouts: make(map[string]*rollout),
 	}
 
 	// queue that invokes backend function to process changes.
 	c.changes = NewChangeQueue(nil)
+	c.changes.OnGiveUp(func(in *Instruction, err error) {
+		glog.Errorf("reconcile %s: giving up after %d retries: %v", in.DesiredState.Address, maxRetries, err)
+		c.mu.Lock()
+		n := *in.DesiredState
+		c.mu.Unlock()
+		c.Event(&n, corev1.EventTypeWarning, "ReconcileRetriesExceeded",
+			fmt.Sprintf("giving up after %d retries: %v", maxRetries, err))
+	})
 
 	// ConfigMap changes
 	configMapInformer.Informer().AddEventHandler(
@@ -84,7 +234,76 @@ func New(kubeclientset kubernetes.Interface, sharedInformers informers.SharedInf
 				c.configMapChange(Update, cur.(*corev1.ConfigMap))
 			},
 			DeleteFunc: func(obj interface{}) {
-				c.configMapChange(Delete, obj.(*corev1.ConfigMap))
+				cm, ok := obj.(*corev1.ConfigMap)
+				if !ok {
+					// missed the delete, the final state is unknown
+					d, ok := obj.(cache.DeletedFinalStateUnknown)
+					if !ok {
+						return
+					}
+					if cm, ok = d.Obj.(*corev1.ConfigMap); !ok {
+						return
+					}
+				}
+				c.configMapChange(Delete, cm)
+			},
+		},
+	)
+
+	// SystemdUnit changes
+	unitInformer.AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.unitChange(Add, obj.(*v1alpha1.SystemdUnit))
+			},
+			UpdateFunc: func(old, cur interface{}) {
+				if reflect.DeepEqual(old.(*v1alpha1.SystemdUnit).Spec, cur.(*v1alpha1.SystemdUnit).Spec) {
+					// only status or metadata changed
+					return
+				}
+				c.unitChange(Update, cur.(*v1alpha1.SystemdUnit))
+			},
+			DeleteFunc: func(obj interface{}) {
+				su, ok := obj.(*v1alpha1.SystemdUnit)
+				if !ok {
+					// missed the delete, the final state is unknown
+					d, ok := obj.(cache.DeletedFinalStateUnknown)
+					if !ok {
+						return
+					}
+					if su, ok = d.Obj.(*v1alpha1.SystemdUnit); !ok {
+						return
+					}
+				}
+				c.unitChange(Delete, su)
+			},
+		},
+	)
+
+	// Secret changes
+	secretInformer.Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.secretChange(obj.(*corev1.Secret))
+			},
+			UpdateFunc: func(old, cur interface{}) {
+				if reflect.DeepEqual(old.(*corev1.Secret).Data, cur.(*corev1.Secret).Data) {
+					return
+				}
+				c.secretChange(cur.(*corev1.Secret))
+			},
+			DeleteFunc: func(obj interface{}) {
+				s, ok := obj.(*corev1.Secret)
+				if !ok {
+					d, ok := obj.(cache.DeletedFinalStateUnknown)
+					if !ok {
+						return
+					}
+					if s, ok = d.Obj.(*corev1.Secret); !ok {
+						return
+					}
+				}
+				c.secretChange(s)
 			},
 		},
 	)
@@ -107,49 +326,244 @@ func New(kubeclientset kubernetes.Interface, sharedInformers informers.SharedInf
 }
 
 // OnChange sets the method that will be called when a Instruction is detected.
-func (kc *kclient) OnChange(fn func(*Instruction)) {
-	kc.changes.OnWork(fn)
+// The Result returned by fn is reported as status of the node.
+// Instructions for which fn returns an error are retried with backoff.
+// fn receives a copy of the node so it can run while the node is being updated.
+func (kc *kclient) OnChange(fn func(*Instruction) (*Result, error)) {
+	kc.changes.OnWork(func(in *Instruction) error {
+		kc.mu.Lock()
+		n := *in.DesiredState
+		kc.mu.Unlock()
+
+		r, err := fn(&Instruction{in.OpCode, &n})
+		if kc.dryRun {
+			// nothing has been done
+			return err
+		}
+		kc.reportResult(in.DesiredState, r, err)
+		kc.rolloutResult(in.DesiredState, n.generation, err)
+		return err
+	})
+}
+
+// SetWorkers sets the number of nodes that are reconciled in parallel.
+func (kc *kclient) SetWorkers(n int) {
+	kc.changes.SetWorkers(n)
+}
+
+// SetResyncPeriod sets the interval at which all ready nodes are reconciled to correct drift.
+// A period of 0 disables resync.
+func (kc *kclient) SetResyncPeriod(d time.Duration) {
+	kc.resyncPeriod = d
+}
+
+// SelectNode limits the nodes that are reconciled to the node with name, as done by an agent that runs on each node.
+// SystemdUnit status isn't updated as an agent only knows about its own node.
+func (kc *kclient) SelectNode(name string) {
+	kc.nodeName = name
+}
+
+// SetStatusClient sets the client that patches the status annotation of Nodes, nil disables the status annotation.
+// An agent uses the credentials of its node, for example the kubeconfig of the kubelet, that are limited to its own Node
+// by the Node authorizer.
+func (kc *kclient) SetStatusClient(c kubernetes.Interface) {
+	kc.statusClient = c
+}
+
+// SetDryRun prevents writes to the cluster, as done when the operator only prints what it would do.
+// Results aren't reported as Node and SystemdUnit status, Events are only logged and changes are rolled out to all
+// nodes at once.
+func (kc *kclient) SetDryRun() {
+	kc.dryRun = true
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(glog.Infof)
+	kc.recorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: operatorName})
 }
 
 // Start the client.
 func (kc *kclient) Run(stopCh chan struct{}, wg *sync.WaitGroup) {
+	for _, f := range kc.factories {
+		f.Start(stopCh)
+	}
+	go kc.unitInformer.Run(stopCh)
 	go kc.changes.run(stopCh, wg)
+	if kc.resyncPeriod > 0 {
+		go kc.resyncLoop(stopCh)
+	}
+}
+
+// ResyncLoop enqueues a Resync Instruction for all ready nodes every resyncPeriod until stopCh is closed.
+func (kc *kclient) resyncLoop(stopCh <-chan struct{}) {
+	t := time.NewTicker(kc.resyncPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-t.C:
+			kc.resync()
+		}
+	}
+}
+
+// Resync enqueues a Resync Instruction for all ready nodes.
+func (kc *kclient) resync() {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	glog.V(2).Infof("resync %d nodes", len(kc.nodes))
+	for _, n := range kc.nodes {
+		if !n.Ready {
+			continue
+		}
+		kc.changes.enqueue(&Instruction{Resync, n})
+	}
 }
 
 // Event receives events and forwards them to the k8s API server so the user knows what's happening.
 // 'resource' is the k8s resource that causes this event
 func (kc *kclient) Event(node *Node, eventType, reason, message string) {
+	if node.resource == nil {
+		return
+	}
 	kc.recorder.Eventf(node.resource, eventType, reason, message)
 }
 
+// UnitEvent receives events about a unit of a node and forwards them to the k8s API server.
+// The event is recorded for the node and for the ConfigMap or SystemdUnit the unit originates from.
+func (kc *kclient) UnitEvent(node *Node, unit, eventType, reason, message string) {
+	kc.Event(node, eventType, reason, unit+" "+message)
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if src := kc.unitSource(node, unit); src != nil {
+		kc.recorder.Eventf(src, eventType, reason, "%s on node %s %s", unit, node.Name, message)
+	}
+}
+
 /***** API Instruction handlers ****************************************************/
 
 // ConfigMapChange
 func (kc *kclient) configMapChange(op OpCode, apiConfigMap *corev1.ConfigMap) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	key := "ConfigMap/" + apiConfigMap.Namespace + "/" + apiConfigMap.Name
+	old, known := kc.unitSets[key]
+
 	// only interested in ConfigMaps with label configLabelKey=configLabelValue
 	// (a more efficient way is to use options.LabelSelector = labels.Set{configLabelKey: configLabelValue}.AsSelector() )
+	// A ConfigMap of which the label is removed is handled as deleted.
 	v, ok := apiConfigMap.ObjectMeta.Labels[configLabelKey]
 	if !ok || v != configLabelValue {
-		return
+		if !known {
+			return
+		}
+		op = Delete
 	}
 
 	glog.V(7).Infof("configMapChange %s %#v", op, apiConfigMap)
 
+	var set *unitSet
 	switch op {
 	case Add, Update:
 		// get units from ConfigMap
-		kc.units = make(map[string]string, len(apiConfigMap.Data))
-		for k, v := range apiConfigMap.Data {
-			kc.units[k] = strings.TrimSpace(v)
+		var err error
+		set, err = newConfigMapUnitSet(apiConfigMap)
+		if err != nil {
+			kc.recorder.Eventf(apiConfigMap, corev1.EventTypeWarning, "InvalidAnnotation", "%v", err)
+		}
+		kc.reportInvalid(set, old)
+		kc.loadSecrets(set)
+		kc.unitSets[key] = set
+		kc.reportCollisions(key)
+	case Delete:
+		// only the units of this ConfigMap are removed
+		delete(kc.unitSets, key)
+	}
+
+	// roll the change out to the affected nodes
+	kc.startRollout(op, key, old, set)
+}
+
+// UnitChange updates the local list of SystemdUnits and visits the nodes.
+func (kc *kclient) unitChange(op OpCode, su *v1alpha1.SystemdUnit) {
+	glog.V(7).Infof("unitChange %s %#v", op, su)
+
+	kc.mu.Lock()
+
+	key := "SystemdUnit/" + su.Namespace + "/" + su.Name
+	old := kc.unitSets[key]
+	var set *unitSet
+	switch op {
+	case Add, Update:
+		var err error
+		set, err = newSystemdUnitSet(su)
+		if err != nil {
+			kc.recorder.Eventf(su, corev1.EventTypeWarning, "InvalidSpec", "%v", err)
 		}
+		kc.reportInvalid(set, old)
+		kc.unitSets[key] = set
+		kc.reportCollisions(key)
 	case Delete:
-		kc.units = nil
+		delete(kc.unitSets, key)
+	}
+
+	// roll the change out to the affected nodes
+	kc.startRollout(op, key, old, set)
+
+	updateStatus := set != nil && kc.nodeName == "" && !kc.dryRun
+	var selected []string
+	if updateStatus {
+		for _, v := range kc.nodes {
+			if set.selects(v) {
+				selected = append(selected, v.Address)
+			}
+		}
+		sort.Strings(selected)
 	}
+	kc.mu.Unlock()
 
-	// queue instructions to visit all nodes
-	for _, v := range kc.nodes {
-		v.Units = kc.units
-		kc.changes.enqueue(&Instruction{op, v})
+	// the status is written without holding the lock so a slow API server doesn't block the reconciles
+	if updateStatus {
+		kc.updateUnitStatus(su, selected)
+	}
+}
+
+// SecretChange rolls out the files of the unit sets that reference a Secret.
+// The content of the Secret is never logged.
+func (kc *kclient) secretChange(s *corev1.Secret) {
+	glog.V(7).Infof("secretChange %s/%s", s.Namespace, s.Name)
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	for _, key := range sortedKeys(kc.unitSets) {
+		old := kc.unitSets[key]
+		if !old.references(s.Namespace, s.Name) {
+			continue
+		}
+		set := old.copy()
+		kc.loadSecrets(set)
+		kc.unitSets[key] = set
+		kc.startRollout(Update, key, old, set)
+	}
+}
+
+// LoadSecrets reads the data of the Secrets referenced by the files of set.
+// A Secret that doesn't exist (yet) or isn't labelled is left out, the files that reference it can't be rendered.
+func (kc *kclient) loadSecrets(set *unitSet) {
+	set.secrets = make(map[string]map[string][]byte)
+	for _, f := range set.files {
+		if f.Secret == "" {
+			continue
+		}
+		s, err := kc.secretLister.Secrets(set.namespace).Get(f.Secret)
+		if err != nil {
+			glog.V(2).Infof("secret %s/%s: %v", set.namespace, f.Secret, err)
+			continue
+		}
+		set.secrets[f.Secret] = s.Data
 	}
 }
 
@@ -157,22 +571,33 @@ func (kc *kclient) configMapChange(op OpCode, apiConfigMap *corev1.ConfigMap) {
 func (kc *kclient) nodeChange(op OpCode, apiNode *corev1.Node) {
 	glog.V(7).Infof("nodeChange %v %v", op, apiNode)
 
-	if kc.configMapStoreSynced() == false {
-		// Ignore node changes as long as ConfigMaps aren't sync'd.
+	if kc.nodeName != "" && apiNode.Name != kc.nodeName {
+		return
+	}
+
+	if kc.configMapStoreSynced() == false || kc.unitStoreSynced() == false || kc.secretStoreSynced() == false {
+		// Ignore node changes as long as ConfigMaps, SystemdUnits and Secrets aren't sync'd.
 		// This is possible because node changes are send frequently.
 		return
 	}
 
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
 	address := apiNode.Status.Addresses[0].Address
 	n, ok := kc.nodes[address]
 	if !ok {
 		n = &Node{
+			Name:    apiNode.Name,
 			Address: address,
 		}
 		kc.nodes[address] = n
 	}
+	n.setInfo(apiNode)
+	n.resource = apiNode
+	n.HostKey = apiNode.Annotations[hostKeyAnnotation]
 
-	var ready bool
+	var ready, changed bool
 	switch op {
 		case Add, Update:
 			for _, c := range apiNode.Status.Conditions {
@@ -181,16 +606,199 @@ func (kc *kclient) nodeChange(op OpCode, apiNode *corev1.Node) {
 					break
 				}
 			}
-			n.Units = kc.units
+			// labels might have changed causing a different selection or rendering of units
+			changed = kc.updateDesired(n)
 			n.LastSeen = time.Now()
 		case Delete:
 			ready = false
-			n.Units = nil
+			n.Desired = Desired{}
+			n.generation++
+			kc.forgetRolloutNode(n)
 	}
 
 	if n.Ready != ready {
 		n.Ready = ready
 		kc.changes.enqueue(&Instruction{op, n})
+	} else if ready && changed {
+		kc.changes.enqueue(&Instruction{Update, n})
+	}
+}
+
+
+/***** Desired state ***************************************************************/
+
+// UpdateDesired sets the desired state of node n and reports the units that can't be rendered.
+// It returns true when the desired state has changed.
+func (kc *kclient) updateDesired(n *Node) bool {
+	desired, errs := kc.nodeDesired(n)
+	kc.reportRenderErrors(n, errs)
+	changed := !reflect.DeepEqual(n.Desired, desired)
+	n.Desired = desired
+	if changed {
+		n.generation++
 	}
+	return changed
 }
 
+// NodeDesired returns the desired state of a node.
+// The result is a merge of the units of all ConfigMaps and SystemdUnits that select the node rendered for the node.
+// When the same unit is defined more than once the set that sorts first by kind/namespace/name wins.
+// A unit that can't be rendered keeps its current content, if any, and is returned as an error.
+func (kc *kclient) nodeDesired(n *Node) (Desired, []renderError) {
+	result := Desired{
+		Units:         make(map[string]string),
+		RestartPolicy: make(map[string]string),
+		Instances:     make(map[string][]string),
+		Files:         make(map[string]File),
+	}
+	var errs []renderError
+	for _, set := range kc.nodeSets(n) {
+		for _, u := range sortedUnitNames(set.units) {
+			if _, ok := result.Units[u]; ok {
+				continue
+			}
+			c, err := set.render(u, n)
+			if err != nil {
+				errs = append(errs, renderError{set.resource, u, err})
+				var ok bool
+				if c, ok = n.Units[u]; !ok {
+					continue
+				}
+			}
+			result.Units[u] = c
+			if p, ok := set.restartPolicy[u]; ok {
+				result.RestartPolicy[u] = p
+			}
+			if _, ok := set.instances[u]; ok {
+				is, err := set.renderInstances(u, c, n)
+				if err != nil {
+					errs = append(errs, renderError{set.resource, u, err})
+					is = n.Instances[u]
+				}
+				if len(is) > 0 {
+					result.Instances[u] = is
+				}
+			}
+		}
+		for _, k := range sortedFileNames(set.files) {
+			fs := set.files[k]
+			if _, ok := result.Files[fs.Path]; ok {
+				continue
+			}
+			f, err := set.renderFile(k, n)
+			if err != nil {
+				errs = append(errs, renderError{set.resource, k, err})
+				var ok bool
+				if f, ok = n.Files[fs.Path]; !ok {
+					continue
+				}
+			}
+			result.Files[fs.Path] = f
+		}
+	}
+
+	return result, errs
+}
+
+// NodeSets returns the unit sets that select node n in merge order.
+// When a rollout of a set is in progress and node n hasn't been updated yet, the version of the set before the
+// rollout is returned.
+func (kc *kclient) nodeSets(n *Node) []*unitSet {
+	keys := make(map[string]struct{}, len(kc.unitSets)+len(kc.rollouts))
+	for k := range kc.unitSets {
+		keys[k] = struct{}{}
+	}
+	for k := range kc.rollouts {
+		keys[k] = struct{}{}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var result []*unitSet
+	for _, k := range sorted {
+		set := kc.unitSets[k]
+		if r, ok := kc.rollouts[k]; ok {
+			if v, ok := r.pending[n]; ok {
+				set = v
+			}
+		}
+		if set == nil || !set.selects(n) {
+			continue
+		}
+		result = append(result, set)
+	}
+	return result
+}
+
+// UnitSource returns the resource that provides unit for node n or nil when the unit isn't desired.
+// The resource is found the same way as nodeDesired merges units.
+func (kc *kclient) unitSource(n *Node, unit string) runtime.Object {
+	for _, set := range kc.nodeSets(n) {
+		if _, ok := set.units[unit]; ok {
+			return set.resource
+		}
+	}
+	return nil
+}
+
+// ReportCollisions emits a Warning Event on the resource of the unit set with key for each unit that is also
+// defined by another set that selects the same node(s).
+func (kc *kclient) reportCollisions(key string) {
+	set := kc.unitSets[key]
+	for _, k := range sortedKeys(kc.unitSets) {
+		if k == key || !kc.overlap(set, kc.unitSets[k]) {
+			continue
+		}
+		for _, u := range set.collisions(kc.unitSets[k]) {
+			winner := key
+			if k < key {
+				winner = k
+			}
+			kc.recorder.Eventf(set.resource, corev1.EventTypeWarning, "UnitCollision",
+				"unit %s is also defined by %s, using the one from %s", u, k, winner)
+		}
+	}
+}
+
+// ReportInvalid validates the units of set and emits a Warning Event for each unit that's rejected.
+func (kc *kclient) reportInvalid(set, old *unitSet) {
+	errs := set.validate(old)
+	for _, u := range sortedUnits(errs) {
+		kc.recorder.Eventf(set.resource, corev1.EventTypeWarning, "InvalidUnit", "unit %s rejected: %v", u, errs[u])
+	}
+}
+
+// Overlap returns true when at least one node is selected by both a and b.
+func (kc *kclient) overlap(a, b *unitSet) bool {
+	for _, n := range kc.nodes {
+		if a.selects(n) && b.selects(n) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateUnitStatus writes the status of a SystemdUnit to the API Server when it has changed.
+func (kc *kclient) updateUnitStatus(su *v1alpha1.SystemdUnit, nodes []string) {
+	if su.Status.ObservedGeneration == su.Generation && reflect.DeepEqual(su.Status.Nodes, nodes) {
+		return
+	}
+
+	u := su.DeepCopy()
+	u.Status.ObservedGeneration = su.Generation
+	u.Status.Nodes = nodes
+	err := kc.unitClient.Put().
+		Namespace(u.Namespace).
+		Resource(v1alpha1.ResourcePlural).
+		Name(u.Name).
+		SubResource("status").
+		Body(u).
+		Do().
+		Error()
+	if err != nil {
+		glog.Errorf("update status SystemdUnit %s/%s: %v", u.Namespace, u.Name, err)
+	}
+}
@@ -0,0 +1,243 @@
+package kclient
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// NewTestClient returns a client of a fake clientset with objects that records its Events in the returned recorder.
+// Only the Secret informer is started, the other resources are passed to the change handlers by the tests.
+func newTestClient(t *testing.T, objects ...runtime.Object) (*kclient, *record.FakeRecorder) {
+	t.Helper()
+	client := fake.NewSimpleClientset(objects...)
+	kc := New(client, nil, informers.NewSharedInformerFactory(client, 0), "nto")
+	recorder := record.NewFakeRecorder(100)
+	kc.recorder = recorder
+
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		kc.changes.queue.ShutDown()
+	})
+	for _, f := range kc.factories {
+		f.Start(stop)
+		for typ, ok := range f.WaitForCacheSync(stop) {
+			if !ok {
+				t.Fatalf("%v informer not synced", typ)
+			}
+		}
+	}
+	return kc, recorder
+}
+
+// AddNode adds a ready node with labels to kc like nodeChange does.
+func addNode(kc *kclient, name, address string, l map[string]string) *Node {
+	n := &Node{Name: name, Address: address, Ready: true}
+	n.setInfo(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: l},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: address}},
+		},
+	})
+	kc.nodes[address] = n
+	return n
+}
+
+// ConfigMap returns a labelled ConfigMap in the default namespace with data in the form key, value, ...
+func configMap(name string, annotations map[string]string, data ...string) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Labels:      map[string]string{configLabelKey: configLabelValue},
+			Annotations: annotations,
+		},
+		Data: make(map[string]string),
+	}
+	for i := 0; i < len(data); i += 2 {
+		cm.Data[data[i]] = data[i+1]
+	}
+	return cm
+}
+
+// Secret returns a Secret in the default namespace with data in the form key, value, ...
+func secret(name string, labelled bool, data ...string) *corev1.Secret {
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Data:       make(map[string][]byte),
+	}
+	if labelled {
+		s.Labels = map[string]string{configLabelKey: configLabelValue}
+	}
+	for i := 0; i < len(data); i += 2 {
+		s.Data[data[i]] = []byte(data[i+1])
+	}
+	return s
+}
+
+// Events returns the reasons of the Events recorded by r.
+func events(r *record.FakeRecorder) []string {
+	var result []string
+	for {
+		select {
+		case e := <-r.Events:
+			// an Event is recorded as '<type> <reason> <message>'
+			result = append(result, strings.Fields(e)[1])
+		default:
+			return result
+		}
+	}
+}
+
+func TestNodeDesired(t *testing.T) {
+	const (
+		service  = "[Service]\nExecStart=/bin/true"
+		rendered = "[Service]\nExecStart=/bin/echo {{.Node.Name}} {{.Params.level}}"
+	)
+	secretFile := map[string]string{
+		filesAnnotation: `{"env": {"path": "/etc/default/nto-env", "secret": "token"}}`,
+	}
+
+	tests := []struct {
+		name    string
+		secrets []runtime.Object
+		cms     []*corev1.ConfigMap
+		labels  map[string]string
+		// wantUnits are the units with their content, wantFiles the paths of the files with their content.
+		wantUnits  map[string]string
+		wantFiles  map[string]string
+		wantErrs   []string
+		wantEvents []string
+	}{
+		{
+			name: "merge",
+			cms: []*corev1.ConfigMap{
+				configMap("a", nil, "a.service", service),
+				configMap("b", nil, "b.service", service),
+			},
+			wantUnits: map[string]string{"a.service": service, "b.service": service},
+		},
+		{
+			name: "collision",
+			cms: []*corev1.ConfigMap{
+				configMap("b", nil, "x.service", service+"\nUser=b"),
+				configMap("a", nil, "x.service", service+"\nUser=a"),
+			},
+			wantUnits:  map[string]string{"x.service": service + "\nUser=a"},
+			wantEvents: []string{"UnitCollision"},
+		},
+		{
+			name: "node selector",
+			cms: []*corev1.ConfigMap{
+				configMap("a", map[string]string{nodeSelectorAnnotation: "gpu"}, "a.service", service),
+				configMap("b", map[string]string{nodeSelectorAnnotation: "!gpu"}, "b.service", service),
+			},
+			labels:    map[string]string{"gpu": "true"},
+			wantUnits: map[string]string{"a.service": service},
+		},
+		{
+			name: "template",
+			cms: []*corev1.ConfigMap{
+				configMap("a", map[string]string{paramsAnnotation: `{"level": "debug"}`}, "a.service", rendered),
+			},
+			wantUnits: map[string]string{"a.service": "[Service]\nExecStart=/bin/echo node1 debug"},
+		},
+		{
+			name: "template error",
+			cms: []*corev1.ConfigMap{
+				configMap("a", nil, "a.service", rendered),
+			},
+			wantUnits: map[string]string{},
+			wantErrs:  []string{"a.service"},
+		},
+		{
+			name:    "secret",
+			secrets: []runtime.Object{secret("token", true, "TOKEN", "s3cr3t")},
+			cms: []*corev1.ConfigMap{
+				configMap("a", secretFile, "a.service", service),
+			},
+			wantUnits: map[string]string{"a.service": service},
+			wantFiles: map[string]string{"/etc/default/nto-env": "TOKEN=\"s3cr3t\"\n"},
+		},
+		{
+			name:    "secret without label",
+			secrets: []runtime.Object{secret("token", false, "TOKEN", "s3cr3t")},
+			cms: []*corev1.ConfigMap{
+				configMap("a", secretFile, "a.service", service),
+			},
+			wantUnits:  map[string]string{"a.service": service},
+			wantErrs:   []string{"env"},
+			wantEvents: []string{"InvalidUnit"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kc, recorder := newTestClient(t, tt.secrets...)
+			n := addNode(kc, "node1", "10.0.0.1", tt.labels)
+			for _, cm := range tt.cms {
+				kc.configMapChange(Add, cm)
+			}
+
+			d, errs := kc.nodeDesired(n)
+			if !reflect.DeepEqual(d.Units, tt.wantUnits) {
+				t.Errorf("units = %v, want %v", d.Units, tt.wantUnits)
+			}
+			files := make(map[string]string)
+			for p, f := range d.Files {
+				files[p] = f.Content
+			}
+			if len(files) > 0 || len(tt.wantFiles) > 0 {
+				if !reflect.DeepEqual(files, tt.wantFiles) {
+					t.Errorf("files = %v, want %v", files, tt.wantFiles)
+				}
+			}
+			var gotErrs []string
+			for _, e := range errs {
+				gotErrs = append(gotErrs, e.unit)
+			}
+			sort.Strings(gotErrs)
+			if !reflect.DeepEqual(gotErrs, tt.wantErrs) {
+				t.Errorf("render errors = %v, want %v", gotErrs, tt.wantErrs)
+			}
+			if got := events(recorder); !reflect.DeepEqual(got, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", got, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func TestConfigMapChange(t *testing.T) {
+	kc, _ := newTestClient(t)
+	n := addNode(kc, "node1", "10.0.0.1", nil)
+	cm := configMap("a", nil, "a.service", "[Service]\nExecStart=/bin/true")
+
+	kc.configMapChange(Add, cm)
+	if _, ok := n.Units["a.service"]; !ok {
+		t.Fatalf("units = %v, want a.service", n.Units)
+	}
+
+	// removing the label removes the units
+	cm = cm.DeepCopy()
+	cm.Labels = nil
+	kc.configMapChange(Update, cm)
+	if _, ok := kc.unitSets["ConfigMap/default/a"]; ok {
+		t.Error("unit set of the unlabelled ConfigMap not removed")
+	}
+	if len(n.Units) != 0 {
+		t.Errorf("units = %v, want none", n.Units)
+	}
+
+	// an unlabelled ConfigMap is ignored
+	kc.configMapChange(Update, cm)
+	if len(kc.unitSets) != 0 {
+		t.Errorf("unit sets = %v, want none", kc.unitSets)
+	}
+}
@@ -0,0 +1,33 @@
+package kclient
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsSubsystem is the Prometheus subsystem of the metrics of this operator.
+const metricsSubsystem = "unit_operator"
+
+var (
+	// reconcileRetries counts the number of times a failed reconcile has been re-queued.
+	reconcileRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: metricsSubsystem,
+			Name:      "reconcile_retries",
+			Help:      "Number of times a failed reconcile of a node is retried.",
+		},
+		[]string{"node"})
+
+	// reconcileGiveUps counts the number of reconciles that are dropped after maxRetries.
+	reconcileGiveUps = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: metricsSubsystem,
+			Name:      "reconcile_retries_exceeded",
+			Help:      "Number of reconciles of a node that failed after the maximum number of retries.",
+		},
+		[]string{"node"})
+)
+
+func init() {
+	prometheus.MustRegister(reconcileRetries)
+	prometheus.MustRegister(reconcileGiveUps)
+}
@@ -2,34 +2,96 @@ package kclient
 
 import (
 	"fmt"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"os"
 	"strings"
 	"time"
 )
 
 // Node represents a k8s node
 type Node struct {
+	// Name of the k8s Node.
+	Name string
 	// Address is the IPv4 address of the node.
 	Address string
 	// Ready is true when node can receive pods.
 	Ready bool
 	// LastSeen time
 	LastSeen time.Time
+	// HostKey is the pinned SSH host key of the node, see hostKeyAnnotation.
+	HostKey string
 
-	// Units contain the desired state of a node.
-	Units map[string]string
+	// Desired state of the node.
+	Desired
 
 	/* Status maintained by back-end */
 
-	//
+	// LastReconcile is the time the last reconcile finished.
 	LastReconcile time.Time
-	//
+	// LastReconcileSuccess is true when the last reconcile completed without errors.
 	LastReconcileSuccess bool
 
 
 	// Private state
 	// Resource is the k8s Node that is changed.
 	resource runtime.Object
+	// Labels of the k8s Node, used to select and render units.
+	labels labels.Set
+	// Annotations of the k8s Node, used to render units.
+	annotations map[string]string
+	// Addresses of the k8s Node by type, used to render units.
+	addresses map[string]string
+	// RenderErrs contains the last reported render error by unit.
+	renderErrs map[string]string
+	// Generation is incremented each time Desired changes.
+	// The copy of the node that's reconciled carries the generation, so a result can be matched to the desired state
+	// it was made for.
+	generation uint64
+}
+
+// Desired is the state a node should be in.
+type Desired struct {
+	// Units maps unit file name to content.
+	// A key in the form <unit>.d_<name>.conf is a drop-in for <unit>.
+	Units map[string]string
+	// RestartPolicy maps unit file name to the restart policy applied after the unit has changed.
+	// A missing entry means 'none'.
+	RestartPolicy map[string]string
+	// Instances maps the file name of a template unit, for example 'backup@.service', to the names of the instances
+	// that are enabled and started.
+	Instances map[string][]string
+	// Files maps path to the files that are installed besides the units.
+	Files map[string]File
+}
+
+// File is a file that's installed on a node besides the units, for example a script that's run by a service.
+type File struct {
+	// Path is the absolute path of the file.
+	Path string
+	// Mode is the permission bits of the file.
+	Mode os.FileMode
+	// Owner is the user:group owning the file.
+	Owner string
+	// Content of the file.
+	Content string
+	// Units are the unit file names that are restarted when the file changes.
+	Units []string
+	// Secret is true when the content is sensitive and must not be logged or printed.
+	Secret bool
+}
+
+// String returns a representation of the receiver that doesn't contain the content of a Secret file.
+func (f File) String() string {
+	if f.Secret {
+		return fmt.Sprintf("{%s %04o %s <secret> %v}", f.Path, f.Mode, f.Owner, f.Units)
+	}
+	return fmt.Sprintf("{%s %04o %s %q %v}", f.Path, f.Mode, f.Owner, f.Content, f.Units)
+}
+
+// GoString is like String, it prevents %#v from dumping the content of a Secret file.
+func (f File) GoString() string {
+	return f.String()
 }
 
 // String returns a human readable representation of the receiver.
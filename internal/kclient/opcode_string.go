@@ -4,9 +4,9 @@ package kclient
 
 import "fmt"
 
-const _OpCode_name = "AddUpdateDeleteIdle"
+const _OpCode_name = "AddUpdateDeleteIdleResync"
 
-var _OpCode_index = [...]uint8{0, 3, 9, 15, 19}
+var _OpCode_index = [...]uint8{0, 3, 9, 15, 19, 25}
 
 func (i OpCode) String() string {
 	if i < 0 || i >= OpCode(len(_OpCode_index)-1) {
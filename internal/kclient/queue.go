@@ -20,33 +20,71 @@ import (
 	//"k8s.io/kubernetes/pkg/util/workqueue"
 	"k8s.io/client-go/util/workqueue"
 	"sync"
+	"time"
 )
 
-// changeQueue manages a queue with a worker function.
+const (
+	// maxRetries is the number of times a failed Instruction is retried before it's dropped.
+	maxRetries = 8
+	// retryBaseDelay and retryMaxDelay are the bounds of the exponential backoff between retries.
+	retryBaseDelay = 5 * time.Second
+	retryMaxDelay  = 5 * time.Minute
+)
+
+// changeQueue manages a queue with a pool of workers.
+// The queue items are Nodes so a node is never processed by two workers at the same time. The OpCode of the pending
+// Instruction of a node is kept in ops.
 type changeQueue struct {
-	// queue is the work queue the worker polls
-	queue *workqueue.Type
+	// queue is the work queue the workers poll
+	queue workqueue.RateLimitingInterface
+	// workers is the number of go routines that process the queue.
+	workers int
 	// workFn is called for each item in the queue.
-	workFn func(*Instruction)
+	// When it returns an error the item is re-queued with backoff.
+	workFn func(*Instruction) error
+	// giveUpFn is called when an item has failed maxRetries times.
+	giveUpFn func(*Instruction, error)
+
+	// mu protects ops.
+	mu sync.Mutex
+	// ops contains the OpCode of the pending Instruction of each queued Node.
+	ops map[*Node]OpCode
 }
 
 // NewChangeQueue creates a queue with a function that's called for every enqueued Instruction.
-func NewChangeQueue(fn func(*Instruction)) *changeQueue {
+func NewChangeQueue(fn func(*Instruction) error) *changeQueue {
 	return &changeQueue{
-		queue:  workqueue.New(),
-		workFn: fn,
+		queue:   workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(retryBaseDelay, retryMaxDelay)),
+		workers: 1,
+		workFn:  fn,
+		ops:     make(map[*Node]OpCode),
 	}
 }
 
 // OnWork sets the function that consumes queued items.
-func (t *changeQueue) OnWork(fn func(*Instruction)) {
+func (t *changeQueue) OnWork(fn func(*Instruction) error) {
 	t.workFn = fn
 }
 
-// run the worker function until the stopCh is closed.
+// OnGiveUp sets the function that is called when an item is dropped after maxRetries failures.
+func (t *changeQueue) OnGiveUp(fn func(*Instruction, error)) {
+	t.giveUpFn = fn
+}
+
+// SetWorkers sets the number of workers that process the queue in parallel.
+func (t *changeQueue) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	t.workers = n
+}
+
+// run the worker functions until the stopCh is closed.
 func (t *changeQueue) run(stopCh <-chan struct{}, wg *sync.WaitGroup) {
 	wg.Add(1)
-	go t.work()
+	for i := 0; i < t.workers; i++ {
+		go t.work()
+	}
 	select {
 	case <-stopCh:
 		t.queue.ShutDown()
@@ -57,21 +95,62 @@ func (t *changeQueue) run(stopCh <-chan struct{}, wg *sync.WaitGroup) {
 }
 
 // enqueue a change for the worker function to process.
+// When an Instruction for the same node is pending the OpCodes are merged; a Resync doesn't overrule other OpCodes.
 func (t *changeQueue) enqueue(ch *Instruction) { //TODO rename to add()
-	t.queue.Add(ch)
+	t.mu.Lock()
+	if op, ok := t.ops[ch.DesiredState]; !ok || ch.OpCode != Resync || op == Resync {
+		t.ops[ch.DesiredState] = ch.OpCode
+	}
+	t.mu.Unlock()
+	t.queue.Add(ch.DesiredState)
 }
 
 // work gets an item from the queue and runs the workFn.
+// Failed items are re-queued with exponential backoff until they have failed maxRetries times.
 func (t *changeQueue) work() {
 	for {
-		change, quit := t.queue.Get()
+		item, quit := t.queue.Get()
 		if quit {
 			return
 		}
-		change2, ok := change.(*Instruction)
+		node, ok := item.(*Node)
 		if ok && t.workFn != nil {
-			t.workFn(change2)
+			t.mu.Lock()
+			op, ok := t.ops[node]
+			delete(t.ops, node)
+			t.mu.Unlock()
+			if !ok {
+				op = Update
+			}
+			in := &Instruction{op, node}
+			t.handleErr(in, t.workFn(in))
 		}
-		t.queue.Done(change)
+		t.queue.Done(item)
+	}
+}
+
+// handleErr re-queues a failed Instruction or gives up on it.
+func (t *changeQueue) handleErr(in *Instruction, err error) {
+	node := in.DesiredState
+	if err == nil {
+		t.queue.Forget(node)
+		return
+	}
+
+	if t.queue.NumRequeues(node) < maxRetries {
+		reconcileRetries.WithLabelValues(node.Address).Inc()
+		t.mu.Lock()
+		if _, ok := t.ops[node]; !ok {
+			t.ops[node] = in.OpCode
+		}
+		t.mu.Unlock()
+		t.queue.AddRateLimited(node)
+		return
+	}
+
+	t.queue.Forget(node)
+	reconcileGiveUps.WithLabelValues(node.Address).Inc()
+	if t.giveUpFn != nil {
+		t.giveUpFn(in, err)
 	}
 }
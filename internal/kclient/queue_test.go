@@ -0,0 +1,82 @@
+package kclient
+
+import (
+	"errors"
+	"testing"
+)
+
+// NewTestQueue returns a queue without workers that is shut down when the test ends.
+func newTestQueue(t *testing.T) *changeQueue {
+	q := NewChangeQueue(nil)
+	t.Cleanup(q.queue.ShutDown)
+	return q
+}
+
+func TestChangeQueueEnqueue(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []OpCode
+		want OpCode
+	}{
+		{name: "single", ops: []OpCode{Add}, want: Add},
+		{name: "resync", ops: []OpCode{Resync}, want: Resync},
+		{name: "last wins", ops: []OpCode{Add, Delete}, want: Delete},
+		{name: "resync doesn't overrule", ops: []OpCode{Update, Resync}, want: Update},
+		{name: "resync is overruled", ops: []OpCode{Resync, Update}, want: Update},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t)
+			n := &Node{Address: "10.0.0.1"}
+			for _, op := range tt.ops {
+				q.enqueue(&Instruction{op, n})
+			}
+			if q.queue.Len() != 1 {
+				t.Errorf("queue length = %d, want 1", q.queue.Len())
+			}
+			if got := q.ops[n]; got != tt.want {
+				t.Errorf("op = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChangeQueueHandleErr(t *testing.T) {
+	q := newTestQueue(t)
+	var gaveUp int
+	q.OnGiveUp(func(*Instruction, error) { gaveUp++ })
+	n := &Node{Address: "10.0.0.1"}
+	errFailed := errors.New("failed")
+
+	// a failure is retried with the OpCode of the failed Instruction
+	q.handleErr(&Instruction{Add, n}, errFailed)
+	if q.ops[n] != Add || q.queue.NumRequeues(n) != 1 {
+		t.Errorf("op = %s, requeues = %d, want Add, 1", q.ops[n], q.queue.NumRequeues(n))
+	}
+
+	// a pending Instruction isn't overruled by the retry
+	delete(q.ops, n)
+	q.enqueue(&Instruction{Delete, n})
+	q.handleErr(&Instruction{Add, n}, errFailed)
+	if q.ops[n] != Delete {
+		t.Errorf("op = %s, want Delete", q.ops[n])
+	}
+
+	// success resets the retries
+	q.handleErr(&Instruction{Add, n}, nil)
+	if q.queue.NumRequeues(n) != 0 {
+		t.Errorf("requeues = %d, want 0", q.queue.NumRequeues(n))
+	}
+
+	// the Instruction is dropped after maxRetries retries
+	for i := 0; i < maxRetries; i++ {
+		q.handleErr(&Instruction{Update, n}, errFailed)
+	}
+	if gaveUp != 0 {
+		t.Fatalf("gave up before %d retries", maxRetries)
+	}
+	q.handleErr(&Instruction{Update, n}, errFailed)
+	if gaveUp != 1 || q.queue.NumRequeues(n) != 0 {
+		t.Errorf("gave up %d times, requeues = %d, want 1, 0", gaveUp, q.queue.NumRequeues(n))
+	}
+}
@@ -0,0 +1,25 @@
+package kclient
+
+// Result is the outcome of reconciling the desired state of a node.
+type Result struct {
+	// Units contains the result of each unit that needed an action.
+	Units []UnitResult
+}
+
+// UnitResult is the outcome of reconciling one unit.
+type UnitResult struct {
+	// Name of the unit file, for example 'test.timer'.
+	Name string
+	// Action taken to reconcile the unit, for example 'create'.
+	Action string
+	// Hash is the sha1 of the unit file on the node after the action.
+	// Empty when the unit is deleted, the action failed or the file contains a Secret.
+	Hash string
+	// Active is the state of the unit after the action, for example 'active/running'.
+	// Empty when not known.
+	Active string
+	// Err is set when the action failed.
+	Err error
+	// RolledBack is true when the action failed and the unit has been restored to its previous state.
+	RolledBack bool
+}
@@ -0,0 +1,201 @@
+package kclient
+
+import (
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"reflect"
+	"sort"
+)
+
+// Rollout applies a change of a unit set to the affected nodes in batches.
+// The next batch is started when all nodes of the current batch are reconciled successfully; a failing node halts
+// the rollout. The rollout resumes when the failed nodes are reconciled successfully, for example by a retry or resync.
+type rollout struct {
+	// op is the OpCode of the change.
+	op OpCode
+	// resource is the k8s resource that changed, used as the object of Events.
+	resource runtime.Object
+	// batchSize is the maximum number of nodes that are updated at the same time.
+	batchSize int
+	// total is the number of nodes affected by the change.
+	total int
+	// pending contains the nodes that haven't been updated yet with the version of the unit set they have.
+	// A nil unit set means the node doesn't have the set.
+	pending map[*Node]*unitSet
+	// inflight contains the nodes of the current batch that haven't reported a result yet with the generation of the
+	// desired state that includes the change.
+	inflight map[*Node]uint64
+	// failed contains the nodes of a batch that failed and haven't been reconciled successfully since with the
+	// generation that failed.
+	failed map[*Node]uint64
+	// halted is true when a node of a batch failed.
+	halted bool
+}
+
+// StartRollout starts rolling out the change of the unit set with key from old to cur.
+// Old is nil when the set is added, cur is nil when the set is deleted.
+// A rollout in progress for the same key is replaced, its pending nodes keep the version of the set they have.
+func (kc *kclient) startRollout(op OpCode, key string, old, cur *unitSet) {
+	params := cur
+	if params == nil {
+		params = old
+	}
+	if params == nil {
+		return
+	}
+
+	prev := kc.rollouts[key]
+	r := &rollout{
+		op:       op,
+		resource: params.resource,
+		pending:  make(map[*Node]*unitSet),
+		inflight: make(map[*Node]uint64),
+		failed:   make(map[*Node]uint64),
+	}
+	kc.rollouts[key] = r
+
+	// only nodes of which the desired state changes take part in the rollout
+	for _, n := range kc.nodes {
+		version := old
+		if prev != nil {
+			if v, ok := prev.pending[n]; ok {
+				version = v
+			}
+		}
+		r.pending[n] = version
+		before, _ := kc.nodeDesired(n)
+		delete(r.pending, n)
+		after, _ := kc.nodeDesired(n)
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+		r.pending[n] = version
+	}
+	r.total = len(r.pending)
+
+	if kc.dryRun {
+		// nothing is changed so there is no need for batches
+		delete(kc.rollouts, key)
+		for n := range r.pending {
+			kc.updateDesired(n)
+			if n.Ready {
+				kc.changes.enqueue(&Instruction{r.op, n})
+			}
+		}
+		return
+	}
+
+	r.batchSize = r.total
+	if params.maxUnavailable != nil {
+		v, err := intstr.GetValueFromIntOrPercent(params.maxUnavailable, r.total, true)
+		if err != nil {
+			kc.recorder.Eventf(r.resource, corev1.EventTypeWarning, "InvalidAnnotation", "maxUnavailable: %v", err)
+		} else if v > 0 {
+			r.batchSize = v
+		}
+	}
+
+	if r.total > 0 {
+		glog.V(2).Infof("rollout %s to %d nodes in batches of %d", key, r.total, r.batchSize)
+	}
+	kc.nextBatch(key, r)
+}
+
+// NextBatch updates the desired state of the next batch of nodes and enqueues them.
+// Nodes that aren't ready are updated without waiting for them, they are reconciled when they become ready.
+func (kc *kclient) nextBatch(key string, r *rollout) {
+	if r.halted {
+		return
+	}
+
+	nodes := make([]*Node, 0, len(r.pending))
+	for n := range r.pending {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Address < nodes[j].Address })
+
+	for _, n := range nodes {
+		if !n.Ready {
+			delete(r.pending, n)
+			kc.updateDesired(n)
+		}
+	}
+	for _, n := range nodes {
+		if len(r.inflight) >= r.batchSize {
+			break
+		}
+		if _, ok := r.pending[n]; !ok {
+			continue
+		}
+		delete(r.pending, n)
+		kc.updateDesired(n)
+		r.inflight[n] = n.generation
+		kc.changes.enqueue(&Instruction{r.op, n})
+	}
+
+	if len(r.pending) == 0 && len(r.inflight) == 0 {
+		delete(kc.rollouts, key)
+		if r.total > 0 {
+			kc.recorder.Eventf(r.resource, corev1.EventTypeNormal, "RolloutCompleted", "updated %d nodes", r.total)
+		}
+	}
+}
+
+// RolloutResult processes the result of a reconcile of generation gen of node n.
+// When n is part of a batch the rollout is continued or halted. A result of a generation before the one that includes
+// the change, for example of a reconcile that was in progress when the batch started, is ignored.
+func (kc *kclient) rolloutResult(n *Node, gen uint64, err error) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	for key, r := range kc.rollouts {
+		if g, ok := r.failed[n]; ok && gen >= g && err == nil {
+			// a retry of a failed node succeeded
+			delete(r.failed, n)
+			if r.halted && len(r.failed) == 0 {
+				r.halted = false
+				glog.Infof("rollout %s resumed: node %s succeeded", key, n.Address)
+				kc.recorder.Eventf(r.resource, corev1.EventTypeNormal, "RolloutResumed",
+					"node %s succeeded, %d of %d nodes not updated", n.Name, len(r.pending), r.total)
+				kc.nextBatch(key, r)
+			}
+			continue
+		}
+		if g, ok := r.inflight[n]; !ok || gen < g {
+			continue
+		}
+		delete(r.inflight, n)
+
+		if err != nil {
+			r.failed[n] = gen
+			if !r.halted {
+				r.halted = true
+				glog.Errorf("rollout %s halted: node %s: %v", key, n.Address, err)
+				kc.recorder.Eventf(r.resource, corev1.EventTypeWarning, "RolloutHalted",
+					"node %s failed: %v, %d of %d nodes not updated", n.Name, err, len(r.pending), r.total)
+			}
+			continue
+		}
+		kc.nextBatch(key, r)
+	}
+}
+
+// ForgetRolloutNode removes node n from the rollouts in progress.
+func (kc *kclient) forgetRolloutNode(n *Node) {
+	for key, r := range kc.rollouts {
+		delete(r.pending, n)
+		if _, ok := r.failed[n]; ok {
+			delete(r.failed, n)
+			if r.halted && len(r.failed) == 0 {
+				r.halted = false
+				kc.nextBatch(key, r)
+			}
+		}
+		if _, ok := r.inflight[n]; ok {
+			delete(r.inflight, n)
+			kc.nextBatch(key, r)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package kclient
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Updated returns the sorted names of the nodes of which the desired state contains unit.
+func updated(kc *kclient, unit string) string {
+	var result []string
+	for _, n := range kc.nodes {
+		if _, ok := n.Units[unit]; ok {
+			result = append(result, n.Name)
+		}
+	}
+	sort.Strings(result)
+	return strings.Join(result, ",")
+}
+
+func TestRollout(t *testing.T) {
+	kc, recorder := newTestClient(t)
+	nodes := []*Node{
+		addNode(kc, "node1", "10.0.0.1", nil),
+		addNode(kc, "node2", "10.0.0.2", nil),
+		addNode(kc, "node3", "10.0.0.3", nil),
+	}
+	key := "ConfigMap/default/a"
+	kc.configMapChange(Add, configMap("a", map[string]string{maxUnavailableAnnotation: "1"},
+		"a.service", "[Service]\nExecStart=/bin/true"))
+	if got := updated(kc, "a.service"); got != "node1" {
+		t.Fatalf("first batch = %s, want node1", got)
+	}
+
+	steps := []struct {
+		name string
+		// node is the index of the node that reports a result.
+		node int
+		// stale is true when the result is of the generation before the batch.
+		stale bool
+		err   error
+		// want are the nodes that have the change after the result.
+		want string
+	}{
+		{name: "reconcile that started before the batch", node: 0, stale: true, want: "node1"},
+		{name: "success starts the next batch", node: 0, want: "node1,node2"},
+		{name: "failure halts", node: 1, err: errors.New("timeout"), want: "node1,node2"},
+		{name: "node outside the batch", node: 0, want: "node1,node2"},
+		{name: "success of the failed node resumes", node: 1, want: "node1,node2,node3"},
+		{name: "last batch", node: 2, want: "node1,node2,node3"},
+	}
+	for _, s := range steps {
+		n := nodes[s.node]
+		gen := n.generation
+		if s.stale {
+			gen--
+		}
+		kc.rolloutResult(n, gen, s.err)
+		if got := updated(kc, "a.service"); got != s.want {
+			t.Errorf("%s: updated = %s, want %s", s.name, got, s.want)
+		}
+	}
+
+	if _, ok := kc.rollouts[key]; ok {
+		t.Error("rollout not completed")
+	}
+	want := []string{"RolloutHalted", "RolloutResumed", "RolloutCompleted"}
+	if got := events(recorder); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestRolloutReplaced(t *testing.T) {
+	kc, _ := newTestClient(t)
+	addNode(kc, "node1", "10.0.0.1", nil)
+	addNode(kc, "node2", "10.0.0.2", nil)
+	annotations := map[string]string{maxUnavailableAnnotation: "1"}
+
+	kc.configMapChange(Add, configMap("a", annotations, "a.service", "[Service]\nExecStart=/bin/true"))
+	// a change during a rollout keeps the version of the nodes that haven't been updated yet
+	kc.configMapChange(Update, configMap("a", annotations,
+		"a.service", "[Service]\nExecStart=/bin/true", "b.service", "[Service]\nExecStart=/bin/true"))
+	if got := updated(kc, "a.service"); got != "node1" {
+		t.Errorf("a.service updated = %s, want node1", got)
+	}
+	if got := updated(kc, "b.service"); got != "node1" {
+		t.Errorf("b.service updated = %s, want node1", got)
+	}
+}
@@ -0,0 +1,89 @@
+package kclient
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"time"
+)
+
+// statusAnnotation is the Node annotation that contains the outcome of the last reconcile as JSON.
+const statusAnnotation = "nto.mmlt.nl/status"
+
+// nodeStatus is the JSON representation of the statusAnnotation.
+type nodeStatus struct {
+	LastReconcile time.Time    `json:"lastReconcile"`
+	Success       bool         `json:"success"`
+	Error         string       `json:"error,omitempty"`
+	Units         []unitStatus `json:"units,omitempty"`
+}
+
+// unitStatus is the JSON representation of an UnitResult.
+type unitStatus struct {
+	Name       string `json:"name"`
+	Action     string `json:"action"`
+	Hash       string `json:"hash,omitempty"`
+	Active     string `json:"active,omitempty"`
+	Error      string `json:"error,omitempty"`
+	RolledBack bool   `json:"rolledBack,omitempty"`
+}
+
+// ReportResult updates the status fields of node n and persists the result of a reconcile as an annotation of the
+// k8s Node when there's a statusClient.
+func (kc *kclient) reportResult(n *Node, r *Result, err error) {
+	kc.mu.Lock()
+	n.LastReconcile = time.Now()
+	n.LastReconcileSuccess = err == nil
+	name := n.Name
+	st := nodeStatus{
+		LastReconcile: n.LastReconcile,
+		Success:       n.LastReconcileSuccess,
+	}
+	kc.mu.Unlock()
+
+	if name == "" || kc.statusClient == nil {
+		return
+	}
+
+	if err != nil {
+		st.Error = err.Error()
+	}
+	if r != nil {
+		for _, u := range r.Units {
+			us := unitStatus{
+				Name:       u.Name,
+				Action:     u.Action,
+				Hash:       u.Hash,
+				Active:     u.Active,
+				RolledBack: u.RolledBack,
+			}
+			if u.Err != nil {
+				us.Error = u.Err.Error()
+			}
+			st.Units = append(st.Units, us)
+		}
+	}
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		glog.Errorf("marshal status of node %s: %v", name, err)
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				statusAnnotation: string(b),
+			},
+		},
+	})
+	if err != nil {
+		glog.Errorf("marshal status patch of node %s: %v", name, err)
+		return
+	}
+
+	_, err = kc.statusClient.CoreV1().Nodes().Patch(name, types.MergePatchType, patch)
+	if err != nil && !apierrors.IsNotFound(err) {
+		glog.Errorf("patch status of node %s: %v", name, err)
+	}
+}
@@ -0,0 +1,258 @@
+package kclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/unitfile"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// Unit content is a text/template that is rendered per node, for example:
+//   ExecStart=/usr/bin/agent --node={{.Node.Name}} --ip={{.Node.Addresses.InternalIP}} --level={{.Params.level}}
+// Use 'index' for values that might be absent, like {{index .Node.Labels "kubernetes.io/role"}}, a missing map key
+// referred to by a field expression is an error.
+
+// zoneLabels are the Node labels that contain the zone, in order of preference.
+var zoneLabels = []string{
+	"topology.kubernetes.io/zone",
+	"failure-domain.beta.kubernetes.io/zone",
+}
+
+// TemplateData is the data a unit template is executed with.
+type templateData struct {
+	Node templateNode
+	// Params are the parameters of the ConfigMap, see paramsAnnotation.
+	Params map[string]interface{}
+}
+
+// TemplateNode is the part of a k8s Node that's available to unit templates.
+type templateNode struct {
+	Name string
+	// Addresses maps address type to address, for example InternalIP to 10.0.0.1
+	Addresses   map[string]string
+	Labels      map[string]string
+	Annotations map[string]string
+	// Zone is the value of the zone label or "" when the Node has no zone.
+	Zone string
+}
+
+// InstanceName matches a valid name of an instance of a template unit.
+var instanceName = regexp.MustCompile(`^[a-zA-Z0-9:_.\-]+$`)
+
+// RenderInstances returns the instances of template unit u with rendered content for node n.
+// The template must have an [Install] section; the operator finds the instances on a host by the symlinks that
+// enabling an instance creates.
+func (set *unitSet) renderInstances(u, content string, n *Node) ([]string, error) {
+	if !strings.Contains(u, "@.") {
+		return nil, fmt.Errorf("instances: %s is not a template unit", u)
+	}
+	if !installable(content) {
+		return nil, fmt.Errorf("instances: %s has no [Install] section with WantedBy= or RequiredBy=", u)
+	}
+	t, err := template.New(u).Option("missingkey=error").Parse(set.instances[u])
+	if err != nil {
+		return nil, fmt.Errorf("instances: %v", err)
+	}
+	var b bytes.Buffer
+	err = t.Execute(&b, templateData{
+		Node:   n.templateNode(),
+		Params: set.params,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("instances: %v", err)
+	}
+
+	var result []string
+	seen := make(map[string]bool)
+	for _, i := range strings.FieldsFunc(b.String(), func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if !instanceName.MatchString(i) {
+			return nil, fmt.Errorf("instances: invalid instance name %q", i)
+		}
+		if !seen[i] {
+			seen[i] = true
+			result = append(result, i)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Installable returns true when unit content has an [Install] section that results in symlinks when it's enabled.
+func installable(content string) bool {
+	f, err := unitfile.Parse(strings.NewReader(content))
+	if err != nil {
+		return false
+	}
+	s := f.Section("Install")
+	if s == nil {
+		return false
+	}
+	for _, k := range []string{"WantedBy", "RequiredBy"} {
+		for _, v := range s.Values(k) {
+			if strings.TrimSpace(v) != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RenderError is a unit that can't be rendered or validated for a node.
+type renderError struct {
+	// resource is the k8s resource that contains the unit.
+	resource runtime.Object
+	unit     string
+	err      error
+}
+
+// SetInfo copies the fields of a k8s Node that are available to unit templates.
+func (n *Node) setInfo(apiNode *corev1.Node) {
+	n.labels = apiNode.Labels
+	n.annotations = apiNode.Annotations
+	n.addresses = make(map[string]string, len(apiNode.Status.Addresses))
+	for _, a := range apiNode.Status.Addresses {
+		if _, ok := n.addresses[string(a.Type)]; !ok {
+			n.addresses[string(a.Type)] = a.Address
+		}
+	}
+}
+
+// TemplateNode returns the template data of node n.
+func (n *Node) templateNode() templateNode {
+	tn := templateNode{
+		Name:        n.Name,
+		Addresses:   n.addresses,
+		Labels:      n.labels,
+		Annotations: n.annotations,
+	}
+	for _, l := range zoneLabels {
+		if z, ok := n.labels[l]; ok {
+			tn.Zone = z
+			break
+		}
+	}
+	return tn
+}
+
+// ParseTemplate parses the content of unit u.
+func parseTemplate(u, content string) (*template.Template, error) {
+	return template.New(u).Option("missingkey=error").Parse(content)
+}
+
+// Render returns the content of unit u for node n.
+// The rendered content is validated, an invalid unit results in an error.
+func (set *unitSet) render(u string, n *Node) (string, error) {
+	t, ok := set.templates[u]
+	if !ok {
+		var err error
+		t, err = parseTemplate(u, set.units[u])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var b bytes.Buffer
+	err := t.Execute(&b, templateData{
+		Node:   n.templateNode(),
+		Params: set.params,
+	})
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimSpace(b.String())
+
+	err = unitfile.ParseAndValidate(s, unitType(u))
+	if err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// RenderFile returns file k for node n.
+func (set *unitSet) renderFile(k string, n *Node) (File, error) {
+	fs := set.files[k]
+	if fs.Secret != "" {
+		data, ok := set.secrets[fs.Secret]
+		if !ok {
+			return File{}, fmt.Errorf("secret %s/%s not found or not labelled %s=%s", set.namespace, fs.Secret,
+				configLabelKey, configLabelValue)
+		}
+		return File{
+			Path:    fs.Path,
+			Mode:    fs.mode,
+			Owner:   fs.Owner,
+			Content: environmentFile(data),
+			Units:   fs.Units,
+			Secret:  true,
+		}, nil
+	}
+
+	t, err := parseTemplate(k, fs.content)
+	if err != nil {
+		return File{}, err
+	}
+	var b bytes.Buffer
+	err = t.Execute(&b, templateData{
+		Node:   n.templateNode(),
+		Params: set.params,
+	})
+	if err != nil {
+		return File{}, err
+	}
+	return File{
+		Path:    fs.Path,
+		Mode:    fs.mode,
+		Owner:   fs.Owner,
+		Content: b.String(),
+		Units:   fs.Units,
+	}, nil
+}
+
+// EnvironmentFile returns data in the format of a systemd EnvironmentFile, one KEY="value" line per item.
+func environmentFile(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	var b bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=\"%s\"\n", k, r.Replace(string(data[k])))
+	}
+	return b.String()
+}
+
+// ReportRenderErrors emits a Warning Event for each unit of node n that can't be rendered.
+// To prevent a flood of Events an error is only reported when it's different from the previous report.
+func (kc *kclient) reportRenderErrors(n *Node, errs []renderError) {
+	reported := make(map[string]string, len(errs))
+	for _, e := range errs {
+		msg := e.err.Error()
+		reported[e.unit] = msg
+		if n.renderErrs[e.unit] == msg {
+			continue
+		}
+		kc.recorder.Eventf(e.resource, corev1.EventTypeWarning, "InvalidUnit",
+			"unit %s on node %s rejected: %s", e.unit, n.Name, msg)
+	}
+	n.renderErrs = reported
+}
+
+// ParseParams parses the JSON object in the paramsAnnotation.
+func parseParams(s string) (map[string]interface{}, error) {
+	var p map[string]interface{}
+	err := json.Unmarshal([]byte(s), &p)
+	if err != nil {
+		return nil, fmt.Errorf("expected a JSON object: %v", err)
+	}
+	return p, nil
+}
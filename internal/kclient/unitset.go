@@ -0,0 +1,361 @@
+package kclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/apis/nto/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// UnitSet is a set of units originating from one k8s resource.
+type unitSet struct {
+	// resource is the k8s resource the units are read from, used as the object of Events.
+	resource runtime.Object
+	// namespace of the resource, Secrets are read from the same namespace.
+	namespace string
+	// selector selects the nodes the units are installed on.
+	selector labels.Selector
+	// units maps unit file name to unit file content.
+	units map[string]string
+	// restartPolicy maps unit file name to the policy applied after the unit has changed.
+	restartPolicy map[string]string
+	// templates contains the parsed units by unit file name.
+	templates map[string]*template.Template
+	// instances maps the file name of a template unit to a template of its instances.
+	instances map[string]string
+	// files maps data item name to the files that are installed besides the units.
+	files map[string]*fileSpec
+	// secrets contains the data of the Secrets that are referenced by files, by Secret name.
+	secrets map[string]map[string][]byte
+	// params are the parameters available to the templates.
+	params map[string]interface{}
+	// maxUnavailable is the maximum number or percentage of nodes that are updated at the same time.
+	// Nil means all nodes.
+	maxUnavailable *intstr.IntOrString
+}
+
+// NewConfigMapUnitSet returns the units contained in a ConfigMap.
+// An invalid node selector annotation results in an error and a set that selects no nodes.
+func newConfigMapUnitSet(cm *corev1.ConfigMap) (*unitSet, error) {
+	set := &unitSet{
+		resource:  cm,
+		namespace: cm.Namespace,
+		selector:  labels.Everything(),
+		units:     make(map[string]string, len(cm.Data)),
+	}
+	for k, v := range cm.Data {
+		set.units[k] = strings.TrimSpace(v)
+	}
+
+	if s, ok := cm.Annotations[restartPolicyAnnotation]; ok {
+		p, err := parseRestartPolicies(s)
+		if err != nil {
+			set.selector = labels.Nothing()
+			return set, fmt.Errorf("annotation %s: %v", restartPolicyAnnotation, err)
+		}
+		set.restartPolicy = p
+	}
+
+	if s, ok := cm.Annotations[paramsAnnotation]; ok {
+		p, err := parseParams(s)
+		if err != nil {
+			set.selector = labels.Nothing()
+			return set, fmt.Errorf("annotation %s: %v", paramsAnnotation, err)
+		}
+		set.params = p
+	}
+
+	if s, ok := cm.Annotations[filesAnnotation]; ok {
+		files, err := parseFiles(s, cm.Data)
+		if err != nil {
+			set.selector = labels.Nothing()
+			return set, fmt.Errorf("annotation %s: %v", filesAnnotation, err)
+		}
+		set.files = files
+		for k := range files {
+			delete(set.units, k)
+		}
+	}
+
+	if s, ok := cm.Annotations[instancesAnnotation]; ok {
+		err := json.Unmarshal([]byte(s), &set.instances)
+		if err != nil {
+			set.selector = labels.Nothing()
+			return set, fmt.Errorf("annotation %s: expected a JSON object: %v", instancesAnnotation, err)
+		}
+	}
+
+	if s, ok := cm.Annotations[maxUnavailableAnnotation]; ok {
+		v := intstr.Parse(s)
+		set.maxUnavailable = &v
+	}
+
+	if s, ok := cm.Annotations[nodeSelectorAnnotation]; ok {
+		sel, err := labels.Parse(s)
+		if err != nil {
+			set.selector = labels.Nothing()
+			return set, fmt.Errorf("annotation %s: %v", nodeSelectorAnnotation, err)
+		}
+		set.selector = sel
+	}
+
+	return set, nil
+}
+
+// NewSystemdUnitSet returns the unit contained in a SystemdUnit.
+// A disabled SystemdUnit results in an empty set.
+// An invalid nodeSelector results in an error and a set that selects no nodes.
+func newSystemdUnitSet(su *v1alpha1.SystemdUnit) (*unitSet, error) {
+	set := &unitSet{
+		resource:  su,
+		namespace: su.Namespace,
+		selector:  labels.Everything(),
+		units:     make(map[string]string, 1),
+	}
+	if su.IsEnabled() {
+		set.units[su.FileName()] = strings.TrimSpace(su.Spec.Content)
+	}
+	set.maxUnavailable = su.Spec.MaxUnavailable
+	if len(su.Spec.Instances) > 0 {
+		set.instances = map[string]string{su.FileName(): strings.Join(su.Spec.Instances, " ")}
+	}
+
+	if p := su.Spec.RestartPolicy; p != "" {
+		if !restartPolicies[p] {
+			set.selector = labels.Nothing()
+			return set, fmt.Errorf("restartPolicy: unknown restart policy %q", p)
+		}
+		set.restartPolicy = map[string]string{su.FileName(): p}
+	}
+
+	if su.Spec.NodeSelector != nil {
+		sel, err := metav1.LabelSelectorAsSelector(su.Spec.NodeSelector)
+		if err != nil {
+			set.selector = labels.Nothing()
+			return set, fmt.Errorf("nodeSelector: %v", err)
+		}
+		set.selector = sel
+	}
+
+	return set, nil
+}
+
+// RestartPolicies are the valid values of a restart policy.
+var restartPolicies = map[string]bool{
+	"none":              true,
+	"reload":            true,
+	"restart":           true,
+	"try-restart":       true,
+	"reload-or-restart": true,
+}
+
+// ParseRestartPolicies parses a string in the form <unit>=<policy>[,<unit>=<policy>...].
+func parseRestartPolicies(s string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("expected <unit>=<policy>, got %q", kv)
+		}
+		u, p := strings.TrimSpace(kv[:i]), strings.TrimSpace(kv[i+1:])
+		if !restartPolicies[p] {
+			return nil, fmt.Errorf("unit %s: unknown restart policy %q", u, p)
+		}
+		result[u] = p
+	}
+	return result, nil
+}
+
+// Selects returns true when the units of the set are to be installed on node n.
+func (set *unitSet) selects(n *Node) bool {
+	return set.selector.Matches(n.labels)
+}
+
+// Validate parses the unit templates of the set.
+// An invalid template is replaced by its version in old so a typo doesn't remove or break an installed unit.
+// When old is nil or doesn't contain the unit, the unit is removed from the set.
+// The rendered units are validated per node, see render.
+// It returns the errors by unit name.
+func (set *unitSet) validate(old *unitSet) map[string]error {
+	errs := make(map[string]error)
+	set.templates = make(map[string]*template.Template, len(set.units))
+	for u, c := range set.units {
+		t, err := parseTemplate(u, c)
+		if err == nil {
+			set.templates[u] = t
+			continue
+		}
+		errs[u] = err
+		if old != nil {
+			if t, ok := old.templates[u]; ok {
+				set.units[u] = old.units[u]
+				set.templates[u] = t
+				continue
+			}
+		}
+		delete(set.units, u)
+	}
+	return errs
+}
+
+// UnitType returns the type of the unit with file name u, for example 'service' for 'test.service'.
+// The type of a drop-in (<unit>.d_<name>.conf) is the type of the unit it modifies.
+func unitType(u string) string {
+	if i := strings.Index(u, dropInSep); i >= 0 {
+		u = u[:i]
+	}
+	return strings.TrimPrefix(path.Ext(u), ".")
+}
+
+// FileSpec is a file that's installed besides the units.
+// The content of the file is a data item or, when Secret is set, the data of a Secret in EnvironmentFile format.
+type fileSpec struct {
+	Path  string   `json:"path"`
+	Mode  string   `json:"mode,omitempty"`
+	Owner string   `json:"owner,omitempty"`
+	Units []string `json:"units,omitempty"`
+	// Secret is the name of a Secret in the namespace of the ConfigMap, the Secret must be labelled operator=nto.
+	// A Secret file is owned by root:root and has mode 0600, Mode and Owner are ignored.
+	Secret string `json:"secret,omitempty"`
+
+	// mode is the parsed Mode.
+	mode os.FileMode
+	// content is the template of the content.
+	content string
+}
+
+// FilePath matches a path of a file that can be passed to a shell without quoting.
+var filePath = regexp.MustCompile(`^/[a-zA-Z0-9@+_./\-]+$`)
+
+// FileOwner matches the user[:group] of a file.
+var fileOwner = regexp.MustCompile(`^[a-z_][a-z0-9_-]*(:[a-z_][a-z0-9_-]*)?$`)
+
+// ParseFiles parses the filesAnnotation and returns the files by data item name.
+// The content of the files is taken from data.
+// The paths that are allowed are checked by the operator, it knows where the files can be installed.
+func parseFiles(s string, data map[string]string) (map[string]*fileSpec, error) {
+	var files map[string]*fileSpec
+	err := json.Unmarshal([]byte(s), &files)
+	if err != nil {
+		return nil, fmt.Errorf("expected a JSON object: %v", err)
+	}
+	for k, f := range files {
+		if !path.IsAbs(f.Path) || path.Clean(f.Path) != f.Path {
+			return nil, fmt.Errorf("file %s: path %q must be absolute and clean", k, f.Path)
+		}
+		if !filePath.MatchString(f.Path) {
+			return nil, fmt.Errorf("file %s: path %q contains characters that aren't allowed", k, f.Path)
+		}
+		if f.Secret != "" {
+			f.mode = 0600
+			f.Owner = "root:root"
+			continue
+		}
+		c, ok := data[k]
+		if !ok {
+			return nil, fmt.Errorf("file %s: no such data item", k)
+		}
+		f.content = c
+		f.mode = 0644
+		if f.Mode != "" {
+			m, err := strconv.ParseUint(f.Mode, 8, 32)
+			if err != nil || m > 07777 {
+				return nil, fmt.Errorf("file %s: invalid mode %q", k, f.Mode)
+			}
+			f.mode = os.FileMode(m)
+		}
+		if f.Owner == "" {
+			f.Owner = "root:root"
+		}
+		if !fileOwner.MatchString(f.Owner) {
+			return nil, fmt.Errorf("file %s: invalid owner %q, expected user[:group]", k, f.Owner)
+		}
+	}
+	return files, nil
+}
+
+// References returns true when a file of the set uses Secret namespace/name.
+func (set *unitSet) references(namespace, name string) bool {
+	if set.namespace != namespace {
+		return false
+	}
+	for _, f := range set.files {
+		if f.Secret == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy returns a shallow copy of the set.
+func (set *unitSet) copy() *unitSet {
+	c := *set
+	return &c
+}
+
+// Collisions returns the sorted names of the units that are in both the receiver and other.
+func (set *unitSet) collisions(other *unitSet) []string {
+	var result []string
+	for u := range set.units {
+		if _, ok := other.units[u]; ok {
+			result = append(result, u)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// SortedUnitNames returns the unit names of a map in sorted order.
+func sortedUnitNames(m map[string]string) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// SortedFileNames returns the data item names of a map of files in sorted order.
+func sortedFileNames(m map[string]*fileSpec) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// SortedUnits returns the unit names of a map in sorted order.
+func sortedUnits(m map[string]error) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// SortedKeys returns the keys of a map of unitSets in sorted order.
+func sortedKeys(sets map[string]*unitSet) []string {
+	result := make([]string, 0, len(sets))
+	for k := range sets {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,106 @@
+package operator
+
+import (
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/systemctl"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A drop-in adds settings to a unit that isn't managed by the operator, for example a vendor supplied kubelet.service.
+// In the desired state a drop-in is named <unit>.d_<name>.conf, on the host it's located at
+// <systemDir>/<unit>.d/<prefix><name>.conf
+// After a drop-in is created or updated the restart policy is applied to the unit it modifies.
+// When a drop-in is removed the unit isn't restarted, the change takes effect the next time the unit (re)starts.
+
+// dropInSep separates the unit name from the drop-in name in a desired state key.
+const dropInSep = ".d_"
+
+// IsDropIn returns true when name is the (host relative) file name of a drop-in.
+func isDropIn(name string) bool {
+	return !isFile(name) && strings.Contains(name, "/")
+}
+
+// DropInTarget returns the unit that is modified by the drop-in with (host relative) file name.
+func dropInTarget(name string) string {
+	return strings.TrimSuffix(path.Dir(name), ".d")
+}
+
+// FileName returns the (host relative) file name of the unit or drop-in with desired state key.
+func (op *operator) fileName(key string) (string, error) {
+	i := strings.Index(key, dropInSep)
+	if i < 0 && isUnprefixed(key) {
+		return key, nil
+	}
+	if i < 0 {
+		return op.prefix + key, nil
+	}
+	unit, name := key[:i], key[i+len(dropInSep):]
+	if unit == "" || !strings.HasSuffix(name, ".conf") || strings.Contains(name, "/") {
+		return "", fmt.Errorf("drop-in %s: expected <unit>%s<name>.conf", key, dropInSep)
+	}
+	if strings.HasPrefix(unit, op.prefix) {
+		// the unit is managed by the operator, change its content instead
+		return "", fmt.Errorf("drop-in %s: unit %s is managed by the operator", key, unit)
+	}
+	return unit + ".d/" + op.prefix + name, nil
+}
+
+// UnitKey returns the desired state key of the unit or drop-in with (host relative) file name.
+// It's the inverse of fileName.
+func (op *operator) unitKey(name string) string {
+	if isUnprefixed(name) {
+		return name
+	}
+	if !isDropIn(name) {
+		return strings.TrimPrefix(name, op.prefix)
+	}
+	return dropInTarget(name) + dropInSep + strings.TrimPrefix(path.Base(name), op.prefix)
+}
+
+// DropIns returns the sorted (host relative) file names of the drop-ins in hash.
+func dropIns(hash map[string]string) []string {
+	var result []string
+	for n := range hash {
+		if isDropIn(n) {
+			result = append(result, n)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// ApplyDropIn copies a drop-in to its unit directory, reloads the systemd configuration and restarts the unit
+// according to policy.
+func applyDropIn(t *transaction, name string, data []byte, policy string) error {
+	_, err := t.cl.Exec("sudo", "mkdir", "-p", path.Join(t.dir, path.Dir(name)))
+	if err != nil {
+		return err
+	}
+	err = t.copyFile(name, data)
+	if err != nil {
+		return err
+	}
+	sc := systemctl.New(t.cl)
+	_, err = sc.DaemonReload()
+	if err != nil {
+		return err
+	}
+	return restartUnit(sc, dropInTarget(name), policy)
+}
+
+// DeleteDropIn removes a drop-in and its unit directory when it has become empty.
+func deleteDropIn(t *transaction, name string) error {
+	err := t.deleteFile(name)
+	if err != nil {
+		return err
+	}
+	_, err = t.cl.Exec("sudo", "rmdir", "--ignore-fail-on-non-empty", path.Join(t.dir, path.Dir(name)))
+	if err != nil {
+		return err
+	}
+	sc := systemctl.New(t.cl)
+	_, err = sc.DaemonReload()
+	return err
+}
@@ -0,0 +1,99 @@
+package operator
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/diff"
+	"github.com/mmlt/systemd-operator/internal/kclient"
+	"io"
+	"os"
+	"strings"
+)
+
+// PrintActions prints the differences between the remote and desired unit files and the systemctl commands that
+// would be run to reconcile them.
+// The content of Secret files and of files that are removed isn't printed, a removed file might have been a Secret.
+// It returns the actions that would be taken.
+func (op *operator) printActions(cl Transport, ip string, d *desired, localHash, remoteHash map[string]string, actions map[string]action) (*kclient.Result, error) {
+	// output is buffered so the output of nodes that are reconciled in parallel isn't interleaved
+	w := &bytes.Buffer{}
+	defer func() { os.Stdout.Write(w.Bytes()) }()
+	fmt.Fprintf(w, "# %s\n", ip)
+
+	// unit files affected by the actions
+	var files []string
+	for _, n := range sortedNames(actions) {
+		if isInstance(n) {
+			// an instance has no file of its own
+			continue
+		}
+		if actions[n] == delete {
+			files = append(files, unitFiles(n, remoteHash)...)
+		} else {
+			files = append(files, unitFiles(n, localHash)...)
+		}
+	}
+	for _, f := range files {
+		fn := op.hostPath(f)
+		if df, ok := d.files[f]; ok && df.Secret {
+			fmt.Fprintf(w, "# %s differs (secret content not shown)\n", fn)
+			continue
+		}
+		if _, ok := d.files[f]; isFile(f) && !ok {
+			fmt.Fprintf(w, "# %s removed (content not shown)\n", fn)
+			continue
+		}
+		remote, err := readFile(cl, fn)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprint(w, diff.Unified(fn, fn, remote, d.cm[f]))
+	}
+
+	fmt.Fprintln(w, "# commands")
+	return op.apply(&dryRunner{w: w}, d, localHash, remoteHash, actions), nil
+}
+
+// ReadFile returns the content of a remote file or an empty string if the file doesn't exist.
+func readFile(cl Transport, name string) (string, error) {
+	s, err := cl.ReadFile(name)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return s, err
+}
+
+// DryRunner is a Transport that prints the systemctl commands instead of running them.
+// Other commands, like the ones that stage and back up files, are internal steps that aren't printed; the changes of
+// files are shown by the diffs.
+type dryRunner struct {
+	w io.Writer
+}
+
+// Exec prints cmd and its arguments when cmd is systemctl.
+func (d *dryRunner) Exec(cmd string, args ...string) (string, error) {
+	c := append([]string{cmd}, args...)
+	if c[0] == "systemctl" || (c[0] == "sudo" && len(c) > 1 && c[1] == "systemctl") {
+		fmt.Fprintln(d.w, strings.Join(c, " "))
+	}
+	return "", nil
+}
+
+// WriteFile does nothing, the change is shown by the diff.
+func (d *dryRunner) WriteFile(path string, data []byte, mode os.FileMode) error {
+	return nil
+}
+
+// ReadFile returns a not exist error, the dry runner has no files.
+func (d *dryRunner) ReadFile(path string) (string, error) {
+	return "", &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
+}
+
+// RemoveFile does nothing, the change is shown by the diff.
+func (d *dryRunner) RemoveFile(path string) error {
+	return nil
+}
+
+// Close does nothing.
+func (d *dryRunner) Close() {
+}
@@ -0,0 +1,232 @@
+package operator
+
+import (
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/kclient"
+	"github.com/mmlt/systemd-operator/internal/systemctl"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Besides units the operator manages files at arbitrary paths, for example scripts that are run by services.
+// In the maps of the operator a file is keyed by its absolute path, units and drop-ins by their path relative to
+// systemDir.
+// The paths of the files that are installed are kept in a manifest on the host so files that are removed from the
+// desired state can be deleted. A second manifest contains the names of the installed units that aren't prefixed, a
+// unit that isn't prefixed and exists but isn't in the manifest isn't taken over either.
+// When a file is created or updated the units that depend on it are restarted if they are running. Units that aren't
+// installed yet are skipped, they are created after the files and start with the new file.
+// The content of a Secret file, an EnvironmentFile rendered from a k8s Secret, is never printed; it is created with
+// mode 0600 so it's not readable by others while it's copied into place.
+// Files can only be installed at paths with one of the filePrefixes, by default /usr/local/libexec/<id>/ and
+// /etc/default/<id>-, so a unit source can't replace files of the host like /etc/sudoers. A file that exists but isn't
+// in the manifest isn't taken over, the file has to be removed from the host first.
+
+// FilePath matches a path that can be passed to a shell without quoting.
+var filePath = regexp.MustCompile(`^/[a-zA-Z0-9@+_./\-]+$`)
+
+// FileOwner matches the user[:group] of a file.
+var fileOwner = regexp.MustCompile(`^[a-z_][a-z0-9_-]*(:[a-z_][a-z0-9_-]*)?$`)
+
+// DefaultFilePrefixes returns the path prefixes of the files that are managed by an operator with operatorId.
+func defaultFilePrefixes(operatorId string) []string {
+	return []string{"/usr/local/libexec/" + operatorId + "/", "/etc/default/" + operatorId + "-"}
+}
+
+// SetFilePrefixes sets the path prefixes of the files that can be managed, for example '/etc/default/nto-' allows
+// '/etc/default/nto-backup' and '/opt/nto/' allows all files in /opt/nto.
+func (op *operator) SetFilePrefixes(prefixes []string) {
+	op.filePrefixes = prefixes
+}
+
+// CheckFile returns an error when f can't be managed because of its path or owner.
+func (op *operator) checkFile(f kclient.File) error {
+	if !filePath.MatchString(f.Path) || path.Clean(f.Path) != f.Path {
+		return fmt.Errorf("path %q isn't allowed", f.Path)
+	}
+	if !fileOwner.MatchString(f.Owner) {
+		return fmt.Errorf("invalid owner %q", f.Owner)
+	}
+	for _, p := range op.filePrefixes {
+		if strings.HasPrefix(f.Path, p) && len(f.Path) > len(p) {
+			return nil
+		}
+	}
+	return fmt.Errorf("path %s isn't in %s", f.Path, strings.Join(op.filePrefixes, ", "))
+}
+
+// Unmanaged returns the files and unprefixed units to create that already exist on the host.
+// As they aren't in a manifest they are owned by someone else.
+func (op *operator) unmanaged(cl Transport, d *desired, localHash, remoteHash map[string]string, actions map[string]action) (map[string]bool, error) {
+	result := make(map[string]bool)
+	for _, n := range sortedNames(actions) {
+		if actions[n] != create {
+			continue
+		}
+		var paths []string
+		switch {
+		case isFile(n) && op.checkFile(d.files[n]) == nil:
+			paths = []string{n}
+		case isUnprefixed(n):
+			for _, f := range unitFiles(n, localHash) {
+				if _, ok := remoteHash[f]; !ok {
+					paths = append(paths, op.hostPath(f))
+				}
+			}
+		}
+		for _, p := range paths {
+			_, err := cl.Exec("sudo", "test", "-e", p)
+			if err != nil {
+				if s, ok := exitStatus(err); ok && s == 1 {
+					// no such file
+					continue
+				}
+				return nil, err
+			}
+			result[n] = true
+		}
+	}
+	return result, nil
+}
+
+// IsFile returns true when name is the path of a file.
+func isFile(name string) bool {
+	return strings.HasPrefix(name, "/")
+}
+
+// ManifestPath returns the path of the manifest on the host.
+func (op *operator) manifestPath() string {
+	return "/var/lib/" + strings.TrimSuffix(op.prefix, "-") + "/files"
+}
+
+// UnitManifestPath returns the path of the manifest of units that aren't prefixed on the host.
+func (op *operator) unitManifestPath() string {
+	return "/var/lib/" + strings.TrimSuffix(op.prefix, "-") + "/units"
+}
+
+// HostPath returns the absolute path on the host of the unit, drop-in or file with name.
+func (op *operator) hostPath(name string) string {
+	if isFile(name) {
+		return name
+	}
+	return path.Join(op.systemDir, name)
+}
+
+// Files returns the sorted paths of the files in hash.
+func files(hash map[string]string) []string {
+	var result []string
+	for n := range hash {
+		if isFile(n) {
+			result = append(result, n)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// GetManifest returns the paths or unit names in the manifest on the host.
+func getManifest(cl Transport, manifest string) ([]string, error) {
+	s, err := readFile(cl, manifest)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if isFile(l) || isUnprefixed(l) {
+			result = append(result, l)
+		}
+	}
+	return result, nil
+}
+
+// GetSha1OfPaths returns a map with key=path and value=sha1 of the files that exist.
+// Sha1sum is run with sudo because files, like EnvironmentFiles with secrets, might only be readable by root.
+func getSha1OfPaths(cl Transport, paths []string) (map[string]string, error) {
+	result := make(map[string]string, len(paths))
+	for _, p := range paths {
+		s, err := cl.Exec("sudo", "sha1sum", p)
+		if err != nil {
+			if s, ok := exitStatus(err); ok && s == 1 {
+				// error indicates no such file
+				continue
+			}
+			return nil, err
+		}
+		if f := strings.Fields(s); len(f) == 2 {
+			result[p] = f[0]
+		}
+	}
+	return result, nil
+}
+
+// ApplyFile writes a file with its mode and owner and restarts the units that depend on it.
+// Unmanaged is true when the file exists but isn't managed, it's left untouched.
+// RemoteHash contains the units that are installed on the host.
+func (op *operator) applyFile(t *transaction, f kclient.File, unmanaged bool, remoteHash map[string]string) error {
+	err := op.checkFile(f)
+	if err != nil {
+		return err
+	}
+	if unmanaged {
+		return fmt.Errorf("file %s exists and isn't managed by the operator, remove it to let the operator manage it",
+			f.Path)
+	}
+	_, err = t.cl.Exec("sudo", "mkdir", "-p", path.Dir(f.Path))
+	if err != nil {
+		return err
+	}
+	if f.Secret {
+		err = t.copySecret(f.Path, []byte(f.Content))
+	} else {
+		err = t.copyFile(f.Path, []byte(f.Content))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = t.cl.Exec("sudo", "chown", f.Owner, f.Path)
+	if err != nil {
+		return err
+	}
+	_, err = t.cl.Exec("sudo", "chmod", fmt.Sprintf("%04o", f.Mode), f.Path)
+	if err != nil {
+		return err
+	}
+
+	sc := systemctl.New(t.cl)
+	for _, u := range f.Units {
+		fn, err := op.fileName(u)
+		if err != nil || isDropIn(fn) || isTemplate(fn) {
+			continue
+		}
+		if _, ok := remoteHash[fn]; !ok {
+			// systemd doesn't know the unit yet
+			continue
+		}
+		err = restartUnit(sc, fn, "try-restart")
+		if err != nil {
+			return fmt.Errorf("restart dependent unit %s: %v", u, err)
+		}
+	}
+	return nil
+}
+
+// WriteManifest writes the paths of the installed files or names of installed units to the manifest on the host.
+// The manifest is only written when it has changed.
+func writeManifest(cl Transport, manifest string, old, paths []string) error {
+	sort.Strings(paths)
+	if strings.Join(old, "\n") == strings.Join(paths, "\n") {
+		return nil
+	}
+	_, err := cl.Exec("sudo", "mkdir", "-p", path.Dir(manifest))
+	if err != nil {
+		return err
+	}
+	var data string
+	if len(paths) > 0 {
+		data = strings.Join(paths, "\n") + "\n"
+	}
+	return copyFile(cl, path.Dir(manifest), path.Base(manifest), []byte(data))
+}
@@ -0,0 +1,86 @@
+package operator
+
+import (
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/kclient"
+	"github.com/mmlt/systemd-operator/internal/systemctl"
+	"strings"
+	"time"
+)
+
+const (
+	// healthTimeout is the maximum time to wait for created or updated units to become active.
+	healthTimeout = 30 * time.Second
+	// healthInterval is the time between checks of the unit states.
+	healthInterval = 2 * time.Second
+)
+
+// WaitActive waits for the created and updated units in r to settle and sets the Active state of those units.
+// Units that are failed or still activating after healthTimeout get an error.
+// Units that are not loaded, for example a oneshot service that has completed, are considered healthy.
+func (op *operator) waitActive(cl Transport, r *kclient.Result) {
+	// index of created/updated units in r.Units by unit file name
+	check := make(map[string]int)
+	for i, u := range r.Units {
+		if strings.Contains(u.Name, dropInSep) {
+			continue
+		}
+		if u.Err == nil && (u.Action == create.String() || u.Action == update.String()) {
+			fn, err := op.fileName(u.Name)
+			if err == nil {
+				check[fn] = i
+			}
+		}
+	}
+	if len(check) == 0 {
+		return
+	}
+	// units that aren't prefixed are listed by name
+	patterns := []string{op.prefix + "*"}
+	for n := range check {
+		if isUnprefixed(n) {
+			patterns = append(patterns, n)
+		}
+	}
+
+	sc := systemctl.New(cl)
+	deadline := time.Now().Add(healthTimeout)
+	for {
+		state := make(map[string]systemctl.Unit)
+		for _, p := range patterns {
+			units, err := sc.ListUnits(p)
+			if err != nil {
+				for _, i := range check {
+					r.Units[i].Err = fmt.Errorf("list units: %v", err)
+				}
+				return
+			}
+			for _, u := range units {
+				state[u.Name] = u
+			}
+		}
+
+		settled := true
+		for n := range check {
+			if u, ok := state[n]; ok && u.Active == "activating" {
+				settled = false
+			}
+		}
+
+		if settled || time.Now().After(deadline) {
+			for n, i := range check {
+				u, ok := state[n]
+				if !ok {
+					continue
+				}
+				r.Units[i].Active = u.Active + "/" + u.Sub
+				if u.Active == "failed" || u.Active == "activating" {
+					r.Units[i].Err = fmt.Errorf("unit is %s (%s)", u.Active, u.Sub)
+				}
+			}
+			return
+		}
+
+		time.Sleep(healthInterval)
+	}
+}
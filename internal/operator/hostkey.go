@@ -0,0 +1,142 @@
+package operator
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/kclient"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"strings"
+)
+
+// The SSH host key of a node is verified against, in order of precedence:
+//   - the key pinned by the node annotation, see kclient.Node HostKey,
+//   - the known_hosts file set with SetKnownHosts,
+//   - the key that's stored in the HostKeyStore when the node was first seen (trust on first use).
+// A node that's not in the known_hosts file falls through to trust on first use.
+// A key that doesn't match refuses the connection, as does a node of which the key can't be verified because none of
+// these are configured. Verification can only be turned off explicitly with SetInsecureIgnoreHostKey.
+
+// HostKeyStore persists the host keys that are trusted on first use.
+type HostKeyStore interface {
+	// HostKey returns the key of node in authorized_keys format or "" when the node has no key.
+	HostKey(node string) (string, error)
+	// SetHostKey stores the key of node in authorized_keys format.
+	SetHostKey(node, key string) error
+}
+
+// HostKeyError is returned when the host key of a node doesn't match the trusted key or the node is unknown.
+type hostKeyError struct {
+	error
+}
+
+// SetKnownHosts sets the known_hosts files to verify host keys with.
+func (op *operator) SetKnownHosts(files ...string) error {
+	cb, err := knownhosts.New(files...)
+	if err != nil {
+		return err
+	}
+	op.knownHosts = cb
+	return nil
+}
+
+// SetHostKeyStore sets the store of host keys that are trusted on first use.
+func (op *operator) SetHostKeyStore(s HostKeyStore) {
+	op.hostKeys = s
+}
+
+// SetInsecureIgnoreHostKey accepts any host key of the nodes that don't have a pinned key when no known_hosts file
+// and HostKeyStore are set.
+func (op *operator) SetInsecureIgnoreHostKey() {
+	op.insecureIgnoreHostKey = true
+}
+
+// HostKeyVerifier verifies the host key of a node during the SSH handshake.
+type hostKeyVerifier struct {
+	op   *operator
+	node *kclient.Node
+	// mismatch is set when the key of the node doesn't match.
+	mismatch *hostKeyError
+	// trust is the key to store when the connection is established.
+	trust string
+}
+
+// Verify is an ssh.HostKeyCallback.
+func (v *hostKeyVerifier) verify(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	err := v.check(hostname, remote, key)
+	if e, ok := err.(*hostKeyError); ok && v.mismatch == nil {
+		v.mismatch = e
+	}
+	return err
+}
+
+// Check returns a *hostKeyError when key isn't trusted.
+func (v *hostKeyVerifier) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if v.node.HostKey != "" {
+		if !keyMatches(v.node.HostKey, key) {
+			return &hostKeyError{fmt.Errorf("host key %s doesn't match pinned key", ssh.FingerprintSHA256(key))}
+		}
+		return nil
+	}
+
+	if v.op.knownHosts != nil {
+		err := v.op.knownHosts(hostname, remote, key)
+		switch e := err.(type) {
+		case nil:
+			return nil
+		case *knownhosts.KeyError:
+			if len(e.Want) > 0 || v.op.hostKeys == nil {
+				// the key mismatches or the host is unknown and there is no fall back
+				return &hostKeyError{fmt.Errorf("host key %s: %v", ssh.FingerprintSHA256(key), err)}
+			}
+		case *knownhosts.RevokedError:
+			return &hostKeyError{err}
+		default:
+			return err
+		}
+	}
+
+	if v.op.hostKeys == nil {
+		if v.op.insecureIgnoreHostKey {
+			return nil
+		}
+		return &hostKeyError{fmt.Errorf("host key %s can't be verified: no pinned key, known_hosts or host key store",
+			ssh.FingerprintSHA256(key))}
+	}
+	stored, err := v.op.hostKeys.HostKey(v.node.Name)
+	if err != nil {
+		// not a mismatch, the reconcile is retried
+		return fmt.Errorf("get stored host key: %v", err)
+	}
+	if stored == "" {
+		v.trust = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		return nil
+	}
+	if !keyMatches(stored, key) {
+		return &hostKeyError{fmt.Errorf("host key %s doesn't match key trusted on first use", ssh.FingerprintSHA256(key))}
+	}
+	return nil
+}
+
+// KeyMatches returns true when key is the same as want.
+// Want is a key in authorized_keys format or a SHA256 fingerprint like 'SHA256:...'.
+func keyMatches(want string, key ssh.PublicKey) bool {
+	want = strings.TrimSpace(want)
+	if strings.HasPrefix(want, "SHA256:") {
+		return want == ssh.FingerprintSHA256(key)
+	}
+	w, _, _, _, err := ssh.ParseAuthorizedKey([]byte(want))
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(w.Marshal(), key.Marshal())
+}
+
+// HostKeyCallback returns the ssh.HostKeyCallback for node.
+func (v *hostKeyVerifier) callback() ssh.HostKeyCallback {
+	if v.node.HostKey == "" && v.op.knownHosts == nil && v.op.hostKeys == nil && v.op.insecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey()
+	}
+	return v.verify
+}
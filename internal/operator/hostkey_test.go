@@ -0,0 +1,138 @@
+package operator
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/mmlt/systemd-operator/internal/kclient"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// FakeHostKeyStore is an in-memory HostKeyStore of which the methods return err.
+type fakeHostKeyStore struct {
+	keys map[string]string
+	err  error
+}
+
+func (s *fakeHostKeyStore) HostKey(node string) (string, error) {
+	return s.keys[node], s.err
+}
+
+func (s *fakeHostKeyStore) SetHostKey(node, key string) error {
+	s.keys[node] = key
+	return s.err
+}
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestHostKeyCheck(t *testing.T) {
+	keyA, keyB := newHostKey(t), newHostKey(t)
+
+	// known_hosts contains key A of 10.0.0.1
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	err := ioutil.WriteFile(knownHostsFile, []byte(knownhosts.Line([]string{"10.0.0.1"}, keyA)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		address    string
+		pin        string
+		knownHosts bool
+		insecure   bool
+		// stored is the key in the HostKeyStore, no store is used when nil
+		stored *string
+		// storeErr is the error of the HostKeyStore
+		storeErr error
+		key      ssh.PublicKey
+		// wantErr is "mismatch" for a *hostKeyError, "error" for another error or "" for none
+		wantErr   string
+		wantTrust string
+	}{
+		{name: "nothing to verify with", key: keyA, wantErr: "mismatch"},
+		{name: "insecure", insecure: true, key: keyA},
+		{name: "insecure with pin mismatch", insecure: true, pin: authorizedKey(keyB), key: keyA, wantErr: "mismatch"},
+		{name: "insecure with known_hosts mismatch", insecure: true, knownHosts: true, key: keyB, wantErr: "mismatch"},
+		{name: "pin authorized key", pin: authorizedKey(keyA), key: keyA},
+		{name: "pin fingerprint", pin: ssh.FingerprintSHA256(keyA), key: keyA},
+		{name: "pin authorized key mismatch", pin: authorizedKey(keyB), key: keyA, wantErr: "mismatch"},
+		{name: "pin fingerprint mismatch", pin: ssh.FingerprintSHA256(keyB), key: keyA, wantErr: "mismatch"},
+		{name: "invalid pin", pin: "ssh-ed25519 invalid", key: keyA, wantErr: "mismatch"},
+		{name: "pin overrides known_hosts", pin: authorizedKey(keyB), knownHosts: true, key: keyB},
+		{name: "pin overrides stored key", pin: authorizedKey(keyB), stored: ptr(authorizedKey(keyA)), key: keyB},
+		{name: "known_hosts", knownHosts: true, key: keyA},
+		{name: "known_hosts mismatch", knownHosts: true, key: keyB, wantErr: "mismatch"},
+		{name: "known_hosts overrides stored key", knownHosts: true, stored: ptr(authorizedKey(keyB)), key: keyA},
+		{name: "known_hosts mismatch with store", knownHosts: true, stored: ptr(""), key: keyB, wantErr: "mismatch"},
+		{name: "unknown host", address: "10.0.0.2", knownHosts: true, key: keyA, wantErr: "mismatch"},
+		{name: "unknown host falls back to first use", address: "10.0.0.2", knownHosts: true, stored: ptr(""),
+			key: keyA, wantTrust: authorizedKey(keyA)},
+		{name: "unknown host trusted on first use", address: "10.0.0.2", knownHosts: true,
+			stored: ptr(authorizedKey(keyA)), key: keyA},
+		{name: "first use", stored: ptr(""), key: keyA, wantTrust: authorizedKey(keyA)},
+		{name: "trusted on first use", stored: ptr(authorizedKey(keyA)), key: keyA},
+		{name: "trusted on first use mismatch", stored: ptr(authorizedKey(keyA)), key: keyB, wantErr: "mismatch"},
+		{name: "store error", stored: ptr(""), storeErr: errors.New("timeout"), key: keyA, wantErr: "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := &operator{insecureIgnoreHostKey: tt.insecure}
+			if tt.knownHosts {
+				if err := op.SetKnownHosts(knownHostsFile); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.stored != nil {
+				op.SetHostKeyStore(&fakeHostKeyStore{keys: map[string]string{"node": *tt.stored}, err: tt.storeErr})
+			}
+			address := tt.address
+			if address == "" {
+				address = "10.0.0.1"
+			}
+			v := &hostKeyVerifier{op: op, node: &kclient.Node{Name: "node", Address: address, HostKey: tt.pin}}
+
+			err := v.callback()(address+":22", &net.TCPAddr{IP: net.ParseIP(address), Port: 22}, tt.key)
+			_, mismatch := err.(*hostKeyError)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("callback error = %v", err)
+			case tt.wantErr == "mismatch" && !mismatch:
+				t.Errorf("callback error = %v, want a host key error", err)
+			case tt.wantErr == "error" && (err == nil || mismatch):
+				t.Errorf("callback error = %v, want an error that isn't a host key error", err)
+			}
+			if mismatch != (v.mismatch != nil) {
+				t.Errorf("mismatch = %v, want %t", v.mismatch, mismatch)
+			}
+			if v.trust != tt.wantTrust {
+				t.Errorf("trust = %q, want %q", v.trust, tt.wantTrust)
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,120 @@
+package operator
+
+import (
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/stringset"
+	"github.com/mmlt/systemd-operator/internal/systemctl"
+	"path"
+	"strings"
+)
+
+// A template unit, like nto-backup@.service, is installed as a file but not enabled or started itself.
+// Instead the instances of the template that are listed in the desired state, like nto-backup@home.service, are
+// enabled and started. When a template timer activates a template service the instances are those of the timer.
+// The instances on a host are found by looking for the symlinks that 'systemctl enable' creates in *.wants/ and
+// *.requires/ directories, kclient rejects the instances of a template without an [Install] section.
+
+// IsTemplate returns true when name is the file name of a template unit, for example 'nto-backup@.service'.
+func isTemplate(name string) bool {
+	return strings.Contains(name, "@.")
+}
+
+// IsInstance returns true when name is the name of an instance of a template unit, for example
+// 'nto-backup@home.service'.
+func isInstance(name string) bool {
+	return strings.Contains(name, "@") && !isTemplate(name) && !isDropIn(name) && !isFile(name)
+}
+
+// InstanceName returns the name of instance i of template unit name.
+func instanceName(name, i string) string {
+	return strings.Replace(name, "@.", "@"+i+".", 1)
+}
+
+// DesiredInstances returns the instances that should be enabled given the templates in localHash.
+// Instances are keyed by (prefixed) template file name.
+func desiredInstances(instances map[string][]string, localHash map[string]string) stringset.Set {
+	result := stringset.New()
+	for _, t := range primaryUnits(localHash) {
+		if !isTemplate(t) {
+			continue
+		}
+		for _, i := range instances[t] {
+			result.Add(instanceName(t, i))
+		}
+	}
+	return result
+}
+
+// GetInstances returns the enabled instances of the template units in dir that start with prefix.
+func getInstances(cl Transport, dir, prefix string) (stringset.Set, error) {
+	result := stringset.New()
+
+	for _, d := range []string{"*.wants", "*.requires"} {
+		s, err := cl.Exec("ls", "-1", path.Join(path.Clean(dir), d, prefix+"*@?*"))
+		if err != nil {
+			if s, ok := exitStatus(err); ok && s == 2 {
+				// error indicates no matching files
+				continue
+			}
+			return nil, err
+		}
+		for _, l := range strings.Split(s, "\n") {
+			l = strings.TrimSpace(l)
+			if l != "" {
+				result.Add(path.Base(l))
+			}
+		}
+	}
+	return result, nil
+}
+
+// CalculateInstanceActions determines the instances to create (enable and start) and delete (stop and disable).
+func calculateInstanceActions(local, remote stringset.Set) map[string]action {
+	actions := make(map[string]action)
+	for n := range local {
+		if !remote.Contains(n) {
+			actions[n] = create
+		}
+	}
+	for n := range remote {
+		if !local.Contains(n) {
+			actions[n] = delete
+		}
+	}
+	return actions
+}
+
+// CreateInstance enables and starts an instance of a template unit.
+func createInstance(t *transaction, name string) error {
+	err := t.unitFile(systemctl.Enable, systemctl.Disable, name)
+	if err != nil {
+		return err
+	}
+	return t.unit(systemctl.Start, systemctl.Stop, name)
+}
+
+// DeleteInstance stops and disables an instance and the instance it activates.
+func deleteInstance(t *transaction, name string) error {
+	if a := activated(name); a != "" {
+		err := t.unit(systemctl.Stop, systemctl.Start, a)
+		if err != nil {
+			return err
+		}
+	}
+	err := t.unit(systemctl.Stop, systemctl.Start, name)
+	if err != nil {
+		return err
+	}
+	return t.unitFile(systemctl.Disable, systemctl.Enable, name)
+}
+
+// RestartInstances applies the restart policy of template unit name to its instances.
+func restartInstances(sc *systemctl.SystemCtl, name string, instances []string, policy string) error {
+	for _, i := range instances {
+		err := restartUnit(sc, instanceName(name, i), policy)
+		if err != nil {
+			return fmt.Errorf("instance %s: %v", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package operator
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsSubsystem is the Prometheus subsystem of the metrics of this operator.
+const metricsSubsystem = "unit_operator"
+
+var (
+	// driftDetected counts the units that have been found to differ from the desired state during a resync.
+	driftDetected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: metricsSubsystem,
+			Name:      "drift_detected",
+			Help:      "Number of units found to differ from the desired state during a resync.",
+		},
+		[]string{"node"})
+
+	// driftedUnits is the number of drifted units found during the last resync of a node.
+	driftedUnits = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: metricsSubsystem,
+			Name:      "drifted_units",
+			Help:      "Number of units that differed from the desired state during the last resync.",
+		},
+		[]string{"node"})
+
+	// failedUnits is the number of units that couldn't be reconciled during the last resync of a node.
+	// A unit that keeps failing is counted by each resync, it isn't drift.
+	failedUnits = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: metricsSubsystem,
+			Name:      "failed_units",
+			Help:      "Number of units that failed to reconcile during the last resync.",
+		},
+		[]string{"node"})
+)
+
+func init() {
+	prometheus.MustRegister(driftDetected)
+	prometheus.MustRegister(driftedUnits)
+	prometheus.MustRegister(failedUnits)
+}
@@ -5,23 +5,75 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"github.com/golang/glog"
-	"github.com/mmlt/sshclient"
 	"github.com/mmlt/systemd-operator/internal/kclient"
+	"github.com/mmlt/systemd-operator/internal/stringset"
 	"github.com/mmlt/systemd-operator/internal/systemctl"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	"os"
 	"path"
 	"sort"
 	"strings"
 )
 
-// TODO add doc
-// assume basename.service and basename.timer match
-// assume files are in /usr/lib64/systemd/system
-// (symlinked from /usr/lib64/systemd/system/multi-user.target.wants/)
+// The operator manages service, timer, socket, path, mount, automount and target units.
+// A timer, socket or path unit activates the service with the same basename, an automount unit activates the mount
+// with the same basename. The activating unit is enabled and started, the activated unit is not.
+// The names of units are prefixed with the operatorId so the operator can find the units it manages. Mount and
+// automount unit names must match the mount point, they aren't prefixed (for example mnt-data.mount mounts /mnt/data)
+// and are kept in a manifest on the host instead, see files.go. A mount unit of the host with the same name in
+// systemDir isn't replaced, creating the unit fails until the unit of the host is removed.
+// Unit files are written to systemDir, /usr/lib64/systemd/system is read-only on some hosts.
+// Besides units the operator manages drop-ins that modify units it doesn't own, see dropin.go
 
 type operator struct {
 	sshUser, sshPass, sshKey string
+	// dial connects to the host of node.
+	dial func(node *kclient.Node) (Transport, error)
+	// knownHosts verifies host keys with known_hosts files, nil when not set.
+	knownHosts ssh.HostKeyCallback
+	// hostKeys stores the host keys that are trusted on first use, nil disables trust on first use.
+	hostKeys HostKeyStore
+	// insecureIgnoreHostKey is true when host keys that can't be verified are accepted.
+	insecureIgnoreHostKey bool
+	// pool keeps SSH connections open between reconciles, nil when connections aren't pooled.
+	pool *pool
 	prefix                   string
 	systemDir                string
+	// filePrefixes are the path prefixes of the files that can be managed, see SetFilePrefixes.
+	filePrefixes []string
+	// dryRun is true when the actions that would be taken are printed instead of performed.
+	dryRun bool
+	// recorder informs the user about the outcome of reconciles.
+	recorder Recorder
+}
+
+// Recorder records Events about nodes and their units.
+type Recorder interface {
+	// Event records an event about a node.
+	Event(node *kclient.Node, eventType, reason, message string)
+	// UnitEvent records an event about an unit of a node.
+	UnitEvent(node *kclient.Node, unit, eventType, reason, message string)
+}
+
+// Desired is the desired state of a host.
+// Units and drop-ins are keyed by their file name relative to systemDir, files by their path.
+type desired struct {
+	// cm contains the content of the units, drop-ins and files.
+	cm map[string]string
+	// policy contains the restart policy of the units and drop-ins.
+	policy map[string]string
+	// instances contains the instances of the template units.
+	instances map[string][]string
+	// files contains the files.
+	files map[string]kclient.File
+	// unmanaged contains the files and unprefixed units to create that already exist on the host, see unmanaged.
+	unmanaged map[string]bool
+}
+
+// DialError is returned when a connection to a host can't be established.
+type dialError struct {
+	error
 }
 
 // Actions to reconcile state.
@@ -35,224 +87,568 @@ const (
 )
 
 // New returns an operator instance.
-func New(sshUser, sshPass, sshKey, operatorId string, systemDir string) *operator {
-	return &operator{
+// When dryRun is true the operator prints what it would do to stdout instead of modifying the hosts.
+func New(sshUser, sshPass, sshKey, operatorId string, systemDir string, dryRun bool) *operator {
+	op := &operator{
 		sshUser:   sshUser,
 		sshPass:   sshPass,
 		sshKey:    sshKey,
 		prefix:    operatorId+"-",
 		systemDir: systemDir,
+		dryRun:    dryRun,
+		filePrefixes: defaultFilePrefixes(operatorId),
+	}
+	op.dial = op.dialSSH
+	return op
+}
+
+// NewLocal returns an operator that reconciles a single host using t, the address of nodes is ignored.
+// For example the host the operator runs on when t is a local or nsenter Transport.
+func NewLocal(t Transport, operatorId string, systemDir string, dryRun bool) *operator {
+	return &operator{
+		dial:         func(*kclient.Node) (Transport, error) { return t, nil },
+		prefix:       operatorId + "-",
+		systemDir:    systemDir,
+		dryRun:       dryRun,
+		filePrefixes: defaultFilePrefixes(operatorId),
 	}
 }
 
-// Update
-func (op *operator) Update(instr *kclient.Instruction) {
+// DialSSH connects to the host of node via SSH and verifies its host key.
+func (op *operator) dialSSH(node *kclient.Node) (Transport, error) {
+	v := &hostKeyVerifier{op: op, node: node}
+	t, err := DialSSH(node.Address, op.sshUser, op.sshPass, op.sshKey, v.callback())
+	if v.mismatch != nil {
+		return nil, v.mismatch
+	}
+	if err != nil {
+		return nil, dialError{fmt.Errorf("dail %s@%s: %v", op.sshUser, node.Address, err)}
+	}
+	if v.trust != "" && op.dryRun {
+		glog.Infof("node %s: dry-run, host key %s not stored", node.Name, v.trust)
+	} else if v.trust != "" {
+		err = op.hostKeys.SetHostKey(node.Name, v.trust)
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("store host key: %v", err)
+		}
+		glog.Infof("node %s: trust host key %s on first use", node.Name, v.trust)
+	}
+	return t, nil
+}
+
+// SetRecorder sets the Recorder that receives the reconcile outcome Events.
+func (op *operator) SetRecorder(r Recorder) {
+	op.recorder = r
+}
+
+// Update reconciles the desired state of an Instruction.
+func (op *operator) Update(instr *kclient.Instruction) (*kclient.Result, error) {
 	glog.V(2).Info(instr.String())
-	err := op.Reconcile(instr.DesiredState.Address, instr.DesiredState.Units)
+	r, err := op.Reconcile(instr.DesiredState)
 	if err != nil {
 		glog.Errorf("reconcile %s: %v", instr.DesiredState.Address, err)
 	}
+	if op.dryRun {
+		// nothing has been done
+		return nil, err
+	}
+	op.recordEvents(instr.DesiredState, r, err)
+	if instr.OpCode == kclient.Resync && r != nil {
+		op.recordDrift(instr.DesiredState, r)
+	}
+	return r, err
 }
 
-// Reconcile
-func (op *operator) Reconcile(ip string, desiredState map[string]string) error {
-	var cl *sshclient.SshClient
-	var err error
-	if op.sshKey != "" {
-		cl, err = sshclient.DailSSHWithKey(ip, op.sshUser, op.sshPass, []byte(op.sshKey))
-	} else {
-		cl, err = sshclient.DailWithPassword(ip, op.sshUser, op.sshPass)
+// RecordDrift counts the units that needed an action during a resync.
+// As the desired state didn't change, those units have been modified on the node. Units of which the action failed
+// are counted separately; they fail on each resync, for example because they can't be verified, which isn't drift.
+func (op *operator) recordDrift(node *kclient.Node, r *kclient.Result) {
+	var drifted, failed int
+	for _, u := range r.Units {
+		if u.Err != nil {
+			failed++
+			continue
+		}
+		drifted++
+		glog.Warningf("drift %s %s: %s", node.Address, u.Name, u.Action)
 	}
+	driftedUnits.WithLabelValues(node.Address).Set(float64(drifted))
+	failedUnits.WithLabelValues(node.Address).Set(float64(failed))
+	if drifted > 0 {
+		driftDetected.WithLabelValues(node.Address).Add(float64(drifted))
+	}
+}
+
+// RecordEvents informs the user about the outcome of a reconcile.
+func (op *operator) recordEvents(node *kclient.Node, r *kclient.Result, err error) {
+	if op.recorder == nil {
+		return
+	}
+
+	if e, ok := err.(*hostKeyError); ok {
+		op.recorder.Event(node, corev1.EventTypeWarning, "HostKeyMismatch", e.Error())
+		return
+	}
+	if _, ok := err.(dialError); ok {
+		op.recorder.Event(node, corev1.EventTypeWarning, "SSHDialFailed", err.Error())
+		return
+	}
+	if r == nil {
+		if err != nil {
+			op.recorder.Event(node, corev1.EventTypeWarning, "ReconcileFailed", err.Error())
+		}
+		return
+	}
+
+	for _, u := range r.Units {
+		if u.Err != nil {
+			reason := "ReconcileFailed"
+			if u.RolledBack {
+				reason = "UnitRolledBack"
+			}
+			op.recorder.UnitEvent(node, u.Name, corev1.EventTypeWarning, reason,
+				fmt.Sprintf("%s failed: %v", u.Action, u.Err))
+			continue
+		}
+		var reason, message string
+		switch u.Action {
+		case create.String():
+			reason, message = "UnitCreated", "created"
+		case update.String():
+			reason, message = "UnitUpdated", "updated"
+		case delete.String():
+			reason, message = "UnitDeleted", "deleted"
+		default:
+			continue
+		}
+		op.recorder.UnitEvent(node, u.Name, corev1.EventTypeNormal, reason, message)
+	}
+}
+
+// Reconcile makes the units, drop-ins and files of a node match its desired state.
+// It returns what has been done per unit.
+func (op *operator) Reconcile(node *kclient.Node) (*kclient.Result, error) {
+	ip := node.Address
+
+	cl, err := op.dial(node)
 	if err != nil {
-		return fmt.Errorf("dail %s@%s: %v\n", op.sshUser, ip)
+		return nil, err
 	}
 	defer cl.Close()
 
 	// Fetch
-	// Convert desiredState to cm[prefixed-name]content map
-	cm := make(map[string]string, len(desiredState))
-	for k, v := range desiredState {
-		cm[op.prefix+k] = v
+	// Convert desired state to cm[file-name]content map, file-name is relative to systemDir or a path
+	d := &desired{
+		cm:        make(map[string]string, len(node.Units)+len(node.Files)),
+		policy:    make(map[string]string, len(node.RestartPolicy)),
+		instances: make(map[string][]string, len(node.Instances)),
+		files:     node.Files,
+	}
+	for k, v := range node.Units {
+		f, err := op.fileName(k)
+		if err != nil {
+			glog.Warningf("node %s: %v", ip, err)
+			continue
+		}
+		d.cm[f] = v
+		d.policy[f] = node.RestartPolicy[k]
+		d.instances[f] = node.Instances[k]
+	}
+	for p, f := range node.Files {
+		d.cm[p] = f.Content
 	}
 	// Get hashes of local and remote content.
-	localHash := getSha1OfMap(cm)
-	remoteHash, err := getSha1OfFiles(cl, path.Join(op.systemDir, op.prefix+"*"))
+	localHash := getSha1OfMap(d.cm)
+	remoteHash, err := getSha1OfFiles(cl, op.systemDir, op.prefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("get sha1: %v", err)
+	}
+	h, err := getSha1OfFiles(cl, op.systemDir, "*.d/"+op.prefix+"*.conf")
+	if err != nil {
+		return nil, fmt.Errorf("get sha1: %v", err)
+	}
+	for k, v := range h {
+		remoteHash[k] = v
+	}
+	manifest, err := getManifest(cl, op.manifestPath())
 	if err != nil {
-		return fmt.Errorf("get sha1: %v", err)
+		return nil, fmt.Errorf("get manifest: %v", err)
+	}
+	h, err = getSha1OfPaths(cl, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("get sha1: %v", err)
+	}
+	for k, v := range h {
+		remoteHash[k] = v
+	}
+	unitManifest, err := getManifest(cl, op.unitManifestPath())
+	if err != nil {
+		return nil, fmt.Errorf("get manifest: %v", err)
+	}
+	for _, n := range unitManifest {
+		h, err = getSha1OfPaths(cl, []string{path.Join(op.systemDir, n)})
+		if err != nil {
+			return nil, fmt.Errorf("get sha1: %v", err)
+		}
+		if v, ok := h[path.Join(op.systemDir, n)]; ok {
+			remoteHash[n] = v
+		}
+	}
+	remoteInstances, err := getInstances(cl, op.systemDir, op.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("get instances: %v", err)
 	}
 
 	// Decode
-	timer, service := calculateActions(localHash, remoteHash)
+	actions := calculateActions(localHash, remoteHash)
+	for n, a := range calculateInstanceActions(desiredInstances(d.instances, localHash), remoteInstances) {
+		actions[n] = a
+	}
 
-	glog.V(2).Info("timer reconcile;", sprintActions(timer))
-	glog.V(2).Info("service reconcile;", sprintActions(service))
+	d.unmanaged, err = op.unmanaged(cl, d, localHash, remoteHash, actions)
+	if err != nil {
+		return nil, fmt.Errorf("get unmanaged: %v", err)
+	}
+
+	glog.V(2).Info("unit reconcile;", sprintActions(actions))
+
+	if op.dryRun {
+		return op.printActions(cl, ip, d, localHash, remoteHash, actions)
+	}
 
 	// Execute
-	cl.SkipOnErr(true)
-	op.apply(cl, cm, timer, service)
-	err = cl.Err()
+	result := op.apply(cl, d, localHash, remoteHash, actions)
+	var installed, installedUnits []string
+	// files and units that couldn't be created aren't managed, for example an unmanaged file that isn't taken over
+	notCreated := make(map[string]bool)
+	for _, u := range result.Units {
+		if u.Action != create.String() || u.Err == nil {
+			continue
+		}
+		notCreated[u.Name] = true
+		if isUnprefixed(u.Name) {
+			for _, f := range unitFiles(u.Name, localHash) {
+				if _, ok := remoteHash[f]; !ok {
+					notCreated[f] = true
+				}
+			}
+		}
+	}
+	for p := range node.Files {
+		if !notCreated[p] {
+			installed = append(installed, p)
+		}
+	}
+	for n := range d.cm {
+		if isUnprefixed(n) && !notCreated[n] {
+			installedUnits = append(installedUnits, n)
+		}
+	}
+	for _, u := range result.Units {
+		if u.Action != delete.String() || u.Err == nil {
+			continue
+		}
+		// keep the file in the manifest so the delete is retried
+		if isFile(u.Name) {
+			installed = append(installed, u.Name)
+		}
+		if isUnprefixed(u.Name) {
+			installedUnits = append(installedUnits, unitFiles(u.Name, remoteHash)...)
+		}
+	}
+	err = writeManifest(cl, op.manifestPath(), manifest, installed)
+	if err != nil {
+		return result, fmt.Errorf("write manifest: %v", err)
+	}
+	err = writeManifest(cl, op.unitManifestPath(), unitManifest, installedUnits)
 	if err != nil {
-		return fmt.Errorf("apply: %v", err)
+		return result, fmt.Errorf("write manifest: %v", err)
+	}
+	op.waitActive(cl, result)
+	var failed int
+	for _, u := range result.Units {
+		if u.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return result, fmt.Errorf("apply: %d of %d units failed", failed, len(result.Units))
 	}
 
-	return nil
+	return result, nil
 }
 
-func (op *operator) apply(cl *sshclient.SshClient, cm map[string]string, timer map[string]action, service map[string]action) {
-	for n, a := range timer {
-		switch a {
-		case create:
-			createTimer(cl, op.systemDir, n, cm[n+".timer"], cm[n+".service"])
-		case update:
-			updateTimer(cl, op.systemDir, n, cm[n+".timer"], cm[n+".service"])
-		case delete:
-			deleteTimer(cl, op.systemDir, n)
+// Apply performs the actions and returns the outcome per unit.
+// Files are created and updated first and deleted last so they're available to the units that use them.
+// Deletes are performed first so a unit can change from being activated by another unit to being standalone.
+// Instances of template units are deleted before and created after the template units.
+// Drop-ins are applied last so they can modify units that have just been created.
+// Created and updated units are verified on the host first, a unit that fails verification is left untouched.
+// Each unit is changed in a transaction; when a step fails the unit is rolled back to its previous state.
+func (op *operator) apply(cl Transport, d *desired, localHash, remoteHash map[string]string, actions map[string]action) *kclient.Result {
+	result := &kclient.Result{}
+
+	names := sortedNames(actions)
+	for _, n := range names {
+		if !isFile(n) || actions[n] == delete {
+			continue
+		}
+		t := op.begin(cl, "/")
+		err := op.applyFile(t, d.files[n], d.unmanaged[n], remoteHash)
+		r := op.finish(t, n, actions[n], localHash, err)
+		if d.files[n].Secret {
+			// the hash of a Secret file would allow a guess of the Secret to be confirmed
+			r.Hash = ""
+		}
+		result.Units = append(result.Units, r)
+	}
+	for _, n := range names {
+		if actions[n] != delete || !isInstance(n) {
+			continue
+		}
+		t := op.begin(cl, op.systemDir)
+		err := deleteInstance(t, n)
+		result.Units = append(result.Units, op.finish(t, n, delete, localHash, err))
+	}
+	for _, n := range names {
+		if actions[n] != delete || isDropIn(n) || isInstance(n) || isFile(n) {
+			continue
 		}
+		t := op.begin(cl, op.systemDir)
+		err := deleteUnit(t, n, unitFiles(n, remoteHash), localHash)
+		result.Units = append(result.Units, op.finish(t, n, delete, localHash, err))
 	}
-	for n, a := range service {
-		switch a {
+	for _, n := range names {
+		if isDropIn(n) || isInstance(n) || isFile(n) {
+			continue
+		}
+		t := op.begin(cl, op.systemDir)
+		var err error
+		switch actions[n] {
 		case create:
-			createService(cl, op.systemDir, n, cm[n+".service"])
+			if d.unmanaged[n] {
+				err = fmt.Errorf("unit %s exists and isn't managed by the operator, remove it to let the operator manage it", n)
+				break
+			}
+			err = verifyUnit(cl, op.stagingDir(), unitFiles(n, localHash), d.cm)
+			if err == nil {
+				err = createUnit(t, n, unitFiles(n, localHash), d.cm)
+			}
 		case update:
-			updateService(cl, op.systemDir, n, cm[n+".service"])
+			err = verifyUnit(cl, op.stagingDir(), unitFiles(n, localHash), d.cm)
+			if err == nil {
+				err = updateUnit(t, unitFiles(n, localHash), d.cm, d.policy, d.instances[n])
+			}
+		default:
+			continue
+		}
+		result.Units = append(result.Units, op.finish(t, n, actions[n], localHash, err))
+	}
+	for _, n := range names {
+		if actions[n] != create || !isInstance(n) {
+			continue
+		}
+		t := op.begin(cl, op.systemDir)
+		err := createInstance(t, n)
+		result.Units = append(result.Units, op.finish(t, n, create, localHash, err))
+	}
+	for _, n := range names {
+		if !isDropIn(n) {
+			continue
+		}
+		t := op.begin(cl, op.systemDir)
+		var err error
+		switch actions[n] {
+		case create, update:
+			err = applyDropIn(t, n, []byte(d.cm[n]), d.policy[n])
 		case delete:
-			deleteService(cl, op.systemDir, n)
+			err = deleteDropIn(t, n)
+		default:
+			continue
+		}
+		result.Units = append(result.Units, op.finish(t, n, actions[n], localHash, err))
+	}
+	for _, n := range names {
+		if !isFile(n) || actions[n] != delete {
+			continue
 		}
+		t := op.begin(cl, "/")
+		err := t.deleteFile(n)
+		result.Units = append(result.Units, op.finish(t, n, delete, localHash, err))
 	}
+
+	return result
+}
+
+// UnitResult returns the outcome of performing action a on the unit, drop-in or file with name.
+func (op *operator) unitResult(name string, a action, localHash map[string]string, err error) kclient.UnitResult {
+	r := kclient.UnitResult{
+		Name:   op.unitKey(name),
+		Action: a.String(),
+		Err:    err,
+	}
+	if err == nil && a != delete {
+		r.Hash = localHash[name]
+	}
+	return r
 }
 
-// CalculateActions determines what actions to perform on timers and services to reconcile local with remote state.
-// It returns a timer and service map with key=name of timer/service and value is the action to perform.
-func calculateActions(localHash map[string]string, remoteHash map[string]string) (timer map[string]action, service map[string]action) {
-	timer = make(map[string]action)
-	service = make(map[string]action)
+// CalculateActions determines what actions to perform on units to reconcile local with remote state.
+// It returns a map with key=name of the unit that isn't activated by another unit, name of the drop-in or path of the
+// file and value is the action to perform.
+// The action applies to the unit and the unit it activates.
+func calculateActions(localHash map[string]string, remoteHash map[string]string) map[string]action {
+	actions := make(map[string]action)
+
+	local := primaryUnits(localHash)
+	remote := stringset.New(primaryUnits(remoteHash)...)
 
 	// what to create or update?
-	for k, _ := range localHash {
-		if !strings.HasSuffix(k, ".service") {
+	for _, n := range local {
+		if !remote.Contains(n) {
+			actions[n] = create
 			continue
 		}
-		// check if .service has corresponding .timer
-		n := strings.TrimSuffix(k, ".service")
-		rtHash, hasRT := remoteHash[n+".timer"]
-		rsHash, hasRS := remoteHash[n+".service"]
-		ltHash, hasLT := localHash[n+".timer"]
-		lsHash, _ := localHash[n+".service"]
-
-		if hasLT {
-			// it's a timer
-			if !(hasRT && hasRS) {
-				// remote .timer or .service file(s) are missing
-				timer[n] = create
-			} else if ltHash != rtHash || lsHash != rsHash {
-				// local and remote .timer or .service files are different
-				timer[n] = update
-			}
-		} else {
-			// it's a service
-			if !hasRS {
-				// remote .service file is missing
-				service[n] = create
-			} else if lsHash != rsHash {
-				// local and remote .service files are different
-				service[n] = update
+		for _, f := range unitFiles(n, localHash) {
+			if h, ok := remoteHash[f]; !ok || h != localHash[f] {
+				// remote file is missing or different
+				actions[n] = update
+				break
 			}
 		}
 	}
 
 	// what to delete?
-	for k, _ := range remoteHash {
-		if !strings.HasSuffix(k, ".service") {
-			continue
+	localSet := stringset.New(local...)
+	for n := range remote {
+		if !localSet.Contains(n) {
+			actions[n] = delete
 		}
-		// check if .service has corresponding .timer
-		n := strings.TrimSuffix(k, ".service")
-		_, hasLT := localHash[n+".timer"]
-		_, hasLS := localHash[n+".service"]
+	}
 
-		if _, ok := remoteHash[n+".timer"]; ok {
-			// it's a timer
-			if !(hasLT && hasLS) {
-				// local .timer or .service file(s) are missing
-				timer[n] = delete
-			}
-		} else {
-			// it's a service
-			if !hasLS {
-				timer[n] = delete
-			}
+	// drop-ins and files
+	for _, n := range append(dropIns(localHash), files(localHash)...) {
+		if h, ok := remoteHash[n]; !ok {
+			actions[n] = create
+		} else if h != localHash[n] {
+			actions[n] = update
+		}
+	}
+	for _, n := range append(dropIns(remoteHash), files(remoteHash)...) {
+		if _, ok := localHash[n]; !ok {
+			actions[n] = delete
 		}
 	}
 
-	return timer, service
-}
-
-func createTimer(cl *sshclient.SshClient, dir, name, timerContent, serviceContent string) {
-	copyFile(cl, dir, name+".timer", []byte(timerContent))
-	copyFile(cl, dir, name+".service", []byte(serviceContent))
-	sc := systemctl.New(cl)
-	sc.Unit(systemctl.Start, name+".timer")
-}
-
-func updateTimer(cl *sshclient.SshClient, dir, name, timerContent, serviceContent string) {
-	copyFile(cl, dir, name+".timer", []byte(timerContent))
-	copyFile(cl, dir, name+".service", []byte(serviceContent))
-	sc := systemctl.New(cl)
-	sc.DaemonReload()
+	return actions
 }
 
-func deleteTimer(cl *sshclient.SshClient, dir, name string) {
-	sc := systemctl.New(cl)
-	sc.Unit(systemctl.Stop, name+".timer")
-	deleteFile(cl, dir, name+".timer")
-	deleteFile(cl, dir, name+".service")
+// CreateUnit copies the files of a unit, enables and starts it.
+// A template unit is not enabled and started, its instances are.
+func createUnit(t *transaction, name string, files []string, cm map[string]string) error {
+	for _, f := range files {
+		err := t.copyFile(f, []byte(cm[f]))
+		if err != nil {
+			return err
+		}
+	}
+	sc := systemctl.New(t.cl)
+	_, err := sc.DaemonReload()
+	if err != nil || isTemplate(name) {
+		return err
+	}
+	err = t.unitFile(systemctl.Enable, systemctl.Disable, name)
+	if err != nil {
+		return err
+	}
+	return t.unit(systemctl.Start, systemctl.Stop, name)
 }
 
-func createService(cl *sshclient.SshClient, dir, name, serviceContent string) {
-	copyFile(cl, dir, name+".service", []byte(serviceContent))
-	sc := systemctl.New(cl)
-	sc.DaemonReload()
-	sc.UnitFile(systemctl.Enable, name+".service")
-	sc.Unit(systemctl.Start, name+".service")
+// UpdateUnit copies the files of a unit, reloads the systemd configuration and applies the restart policy of each file.
+// The restart policy of a template unit is applied to instances.
+// Without a policy the change takes effect the next time the unit starts.
+func updateUnit(t *transaction, files []string, cm, policy map[string]string, instances []string) error {
+	for _, f := range files {
+		err := t.copyFile(f, []byte(cm[f]))
+		if err != nil {
+			return err
+		}
+	}
+	sc := systemctl.New(t.cl)
+	_, err := sc.DaemonReload()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if isTemplate(f) {
+			err = restartInstances(sc, f, instances, policy[f])
+		} else {
+			err = restartUnit(sc, f, policy[f])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func updateService(cl *sshclient.SshClient, dir, name, serviceContent string) {
-	copyFile(cl, dir, name+".service", []byte(serviceContent))
-	sc := systemctl.New(cl)
-	sc.DaemonReload()
+// DeleteUnit stops and disables a unit and the unit it activates and removes their files.
+// A template unit is only removed, its instances have been stopped and disabled before.
+// Files that are in keep are not removed because they are (re)used by another unit.
+func deleteUnit(t *transaction, name string, files []string, keep map[string]string) error {
+	if !isTemplate(name) {
+		for _, f := range files {
+			err := t.unit(systemctl.Stop, systemctl.Start, f)
+			if err != nil {
+				return err
+			}
+		}
+		err := t.unitFile(systemctl.Disable, systemctl.Enable, name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if _, ok := keep[f]; ok {
+			continue
+		}
+		err := t.deleteFile(f)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := systemctl.New(t.cl).DaemonReload()
+	return err
 }
 
-func deleteService(cl *sshclient.SshClient, dir, name string) {
-	sc := systemctl.New(cl)
-	sc.Unit(systemctl.Stop, name+".service")
-	sc.UnitFile(systemctl.Disable, name+".service")
-	deleteFile(cl, dir, name+".service")
+// CopyFile copies data to a file (644 root root name) on a remote host.
+// Name is relative to dir.
+func copyFile(cl Transport, dir string, name string, data []byte) error {
+	return copyFileMode(cl, dir, name, data, 0644)
 }
 
-// CopyFile copies data to a file (664 root root name) on a remote host.
-// Assume non root user in sudo group.
-func copyFile(cl *sshclient.SshClient, dir string, name string, data []byte) {
-	fn := "/var/tmp/" + name // temporary file location
-	cl.ScpTo(data, fn, 0644)
-	cl.Exec("sudo", "chown", "root:root", fn)
-	cl.Exec("sudo", "mv", fn, dir)
+// CopyFileMode is like copyFile with the mode of the file.
+func copyFileMode(cl Transport, dir string, name string, data []byte, mode os.FileMode) error {
+	return cl.WriteFile(path.Join(dir, name), data, mode)
 }
 
 // DeleteFile from a remote host.
-// Assume non root user in sudo group.
-func deleteFile(cl *sshclient.SshClient, dir string, name string) {
-	cl.Exec("sudo", "rm", path.Join(dir, name))
+func deleteFile(cl Transport, dir string, name string) error {
+	return cl.RemoveFile(path.Join(dir, name))
 }
 
-// GetSha1OfFiles returns a map with key=name of file and value=sha1 of file.
-func getSha1OfFiles(cl *sshclient.SshClient, pattern string) (map[string]string, error) {
+// GetSha1OfFiles returns a map with key=name of file relative to dir and value=sha1 of file for the files in dir that
+// match pattern.
+func getSha1OfFiles(cl Transport, dir, pattern string) (map[string]string, error) {
 	result := make(map[string]string)
 
-	s, err := cl.Exec("sha1sum", pattern)
+	dir = path.Clean(dir)
+	s, err := cl.Exec("sha1sum", path.Join(dir, pattern))
 	if err != nil {
-		if strings.HasSuffix(err.Error(), "Process exited with status 1") {
+		if s, ok := exitStatus(err); ok && s == 1 {
 			// error indicates no matching files
-			return nil, nil
+			return result, nil
 		}
 		return nil, err
 	}
@@ -261,7 +657,7 @@ func getSha1OfFiles(cl *sshclient.SshClient, pattern string) (map[string]string,
 	for sc.Scan() {
 		f := strings.Fields(sc.Text())
 		if len(f) == 2 {
-			result[path.Base(f[1])] = f[0]
+			result[strings.TrimPrefix(f[1], dir+"/")] = f[0]
 		}
 	}
 
@@ -284,20 +680,25 @@ func getSha1OfMap(content map[string]string) map[string]string {
 	return result
 }
 
+// SortedNames returns the names of the units in sorted order.
+func sortedNames(unit map[string]action) []string {
+	var ks []string
+	for k := range unit {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
 // SprintActions returns a string of service:action pairs.
 func sprintActions(unit map[string]action) string {
 	if len(unit) == 0 {
 		return " no actions"
 	}
 
-	var ks []string
-	for k, _ := range unit {
-		ks = append(ks, k)
-	}
-	sort.Strings(ks)
 	var r string
-	for _, n := range ks {
-		r = fmt.Sprintf("%s %s:%d", r, n, unit[n]) //TODO %s unit[n].String()
+	for _, n := range sortedNames(unit) {
+		r = fmt.Sprintf("%s %s:%s", r, n, unit[n])
 	}
 	return r
 }
\ No newline at end of file
@@ -0,0 +1,474 @@
+package operator
+
+import (
+	"github.com/mmlt/systemd-operator/internal/fakehost"
+	"github.com/mmlt/systemd-operator/internal/kclient"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	service = "[Unit]\nDescription=test\n\n[Service]\nExecStart=/usr/bin/sleep infinity\n"
+	// installedService is a service that is enabled and started when it's not activated by another unit.
+	installedService = service + "\n[Install]\nWantedBy=multi-user.target\n"
+	timer            = "[Unit]\nDescription=test\n\n[Timer]\nOnCalendar=hourly\n\n[Install]\nWantedBy=timers.target\n"
+)
+
+// Reconcile reconciles host h to the desired state and returns the actions by unit.
+func reconcile(t *testing.T, h *fakehost.Host, d kclient.Desired) (map[string]string, error) {
+	t.Helper()
+	op := NewLocal(h, "nto", fakehost.SystemDir, false)
+	r, err := op.Reconcile(&kclient.Node{Name: "node", Address: "10.0.0.1", Desired: d})
+	if r == nil {
+		t.Fatalf("Reconcile() returned no result: %v", err)
+	}
+	actions := make(map[string]string)
+	for _, u := range r.Units {
+		actions[u.Name] = u.Action
+		if u.Err != nil {
+			actions[u.Name] += " failed"
+		}
+		if u.RolledBack {
+			actions[u.Name] += " rolled back"
+		}
+	}
+	return actions, err
+}
+
+// MustReconcile is like reconcile and fails the test on an error.
+func mustReconcile(t *testing.T, h *fakehost.Host, d kclient.Desired) map[string]string {
+	t.Helper()
+	actions, err := reconcile(t, h, d)
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	return actions
+}
+
+func units(kv ...string) kclient.Desired {
+	d := kclient.Desired{Units: make(map[string]string)}
+	for i := 0; i < len(kv); i += 2 {
+		d.Units[kv[i]] = kv[i+1]
+	}
+	return d
+}
+
+func assertActions(t *testing.T, got map[string]string, want map[string]string) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("actions = %v, want %v", got, want)
+	}
+}
+
+func assertFile(t *testing.T, h *fakehost.Host, path, data string) {
+	t.Helper()
+	f, ok := h.File(path)
+	if !ok {
+		t.Errorf("%s doesn't exist", path)
+		return
+	}
+	if f.Data != data {
+		t.Errorf("%s = %q, want %q", path, f.Data, data)
+	}
+}
+
+func assertNoFile(t *testing.T, h *fakehost.Host, path string) {
+	t.Helper()
+	if _, ok := h.File(path); ok {
+		t.Errorf("%s exists", path)
+	}
+}
+
+func assertState(t *testing.T, h *fakehost.Host, unit string, enabled bool, active string) {
+	t.Helper()
+	if h.Enabled(unit) != enabled {
+		t.Errorf("%s enabled = %t, want %t", unit, h.Enabled(unit), enabled)
+	}
+	if h.ActiveState(unit) != active {
+		t.Errorf("%s active = %s, want %s", unit, h.ActiveState(unit), active)
+	}
+}
+
+func TestCalculateActions(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  map[string]string
+		remote map[string]string
+		want   map[string]action
+	}{
+		{
+			name:  "create service and timer",
+			local: map[string]string{"a.service": "1", "a.timer": "2"},
+			want:  map[string]action{"a.timer": create},
+		},
+		{
+			name:   "update activated service",
+			local:  map[string]string{"a.service": "1", "a.timer": "2"},
+			remote: map[string]string{"a.service": "0", "a.timer": "2"},
+			want:   map[string]action{"a.timer": update},
+		},
+		{
+			name:   "missing activated service",
+			local:  map[string]string{"a.service": "1", "a.timer": "2"},
+			remote: map[string]string{"a.timer": "2"},
+			want:   map[string]action{"a.timer": update},
+		},
+		{
+			name:   "no changes",
+			local:  map[string]string{"a.service": "1", "a.timer": "2"},
+			remote: map[string]string{"a.service": "1", "a.timer": "2"},
+			want:   map[string]action{},
+		},
+		{
+			name:   "delete",
+			remote: map[string]string{"a.service": "1", "a.timer": "2"},
+			want:   map[string]action{"a.timer": delete},
+		},
+		{
+			name:   "service becomes activated by timer",
+			local:  map[string]string{"a.service": "1", "a.timer": "2"},
+			remote: map[string]string{"a.service": "1"},
+			want:   map[string]action{"a.service": delete, "a.timer": create},
+		},
+		{
+			name:   "timer removed from service",
+			local:  map[string]string{"a.service": "1"},
+			remote: map[string]string{"a.service": "1", "a.timer": "2"},
+			want:   map[string]action{"a.service": create, "a.timer": delete},
+		},
+		{
+			name:   "socket and automount pairs",
+			local:  map[string]string{"a.service": "1", "a.socket": "2", "b.mount": "3", "b.automount": "4"},
+			remote: map[string]string{"a.service": "1", "a.socket": "2", "b.mount": "0", "b.automount": "4"},
+			want:   map[string]action{"b.automount": update},
+		},
+		{
+			name:   "drop-ins and files",
+			local:  map[string]string{"k.service.d/nto-a.conf": "1", "k.service.d/nto-b.conf": "2", "/etc/a": "3"},
+			remote: map[string]string{"k.service.d/nto-b.conf": "0", "k.service.d/nto-c.conf": "1", "/etc/b": "3"},
+			want: map[string]action{
+				"k.service.d/nto-a.conf": create,
+				"k.service.d/nto-b.conf": update,
+				"k.service.d/nto-c.conf": delete,
+				"/etc/a":                 create,
+				"/etc/b":                 delete,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := calculateActions(tt.local, tt.remote)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("calculateActions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileServiceAndTimer(t *testing.T) {
+	h := fakehost.New()
+
+	got := mustReconcile(t, h, units("a.service", service, "a.timer", timer))
+	assertActions(t, got, map[string]string{"a.timer": "create"})
+	assertFile(t, h, "/etc/systemd/system/nto-a.service", service)
+	assertFile(t, h, "/etc/systemd/system/nto-a.timer", timer)
+	assertState(t, h, "nto-a.timer", true, "active")
+	assertState(t, h, "nto-a.service", false, "inactive")
+
+	got = mustReconcile(t, h, units("a.service", service, "a.timer", timer))
+	assertActions(t, got, map[string]string{})
+
+	changed := strings.Replace(service, "infinity", "60", 1)
+	got = mustReconcile(t, h, units("a.service", changed, "a.timer", timer))
+	assertActions(t, got, map[string]string{"a.timer": "update"})
+	assertFile(t, h, "/etc/systemd/system/nto-a.service", changed)
+
+	got = mustReconcile(t, h, units())
+	assertActions(t, got, map[string]string{"a.timer": "delete"})
+	assertNoFile(t, h, "/etc/systemd/system/nto-a.service")
+	assertNoFile(t, h, "/etc/systemd/system/nto-a.timer")
+	assertState(t, h, "nto-a.timer", false, "inactive")
+}
+
+func TestReconcilePairingChange(t *testing.T) {
+	h := fakehost.New()
+
+	mustReconcile(t, h, units("a.service", installedService))
+	assertState(t, h, "nto-a.service", true, "active")
+
+	got := mustReconcile(t, h, units("a.service", installedService, "a.timer", timer))
+	assertActions(t, got, map[string]string{"a.service": "delete", "a.timer": "create"})
+	assertFile(t, h, "/etc/systemd/system/nto-a.service", installedService)
+	assertState(t, h, "nto-a.service", false, "inactive")
+	assertState(t, h, "nto-a.timer", true, "active")
+
+	got = mustReconcile(t, h, units("a.service", installedService))
+	assertActions(t, got, map[string]string{"a.service": "create", "a.timer": "delete"})
+	assertNoFile(t, h, "/etc/systemd/system/nto-a.timer")
+	assertState(t, h, "nto-a.service", true, "active")
+}
+
+func TestReconcileInstances(t *testing.T) {
+	h := fakehost.New()
+	d := units("b@.service", installedService)
+	d.Instances = map[string][]string{"b@.service": {"x", "y"}}
+
+	got := mustReconcile(t, h, d)
+	assertActions(t, got, map[string]string{"b@.service": "create", "b@x.service": "create", "b@y.service": "create"})
+	assertState(t, h, "nto-b@x.service", true, "active")
+	assertState(t, h, "nto-b@y.service", true, "active")
+
+	got = mustReconcile(t, h, d)
+	assertActions(t, got, map[string]string{})
+
+	d.Instances = map[string][]string{"b@.service": {"y", "z"}}
+	got = mustReconcile(t, h, d)
+	assertActions(t, got, map[string]string{"b@x.service": "delete", "b@z.service": "create"})
+	assertState(t, h, "nto-b@x.service", false, "inactive")
+	assertState(t, h, "nto-b@z.service", true, "active")
+
+	got = mustReconcile(t, h, units())
+	assertActions(t, got, map[string]string{"b@.service": "delete", "b@y.service": "delete", "b@z.service": "delete"})
+	assertNoFile(t, h, "/etc/systemd/system/nto-b@.service")
+	if p := h.Paths("/etc/systemd/system/*/*"); len(p) > 0 {
+		t.Errorf("links left: %v", p)
+	}
+}
+
+func TestReconcileDropIn(t *testing.T) {
+	h := fakehost.New()
+	h.SetFile("/etc/systemd/system/kubelet.service", installedService, 0644)
+	h.Exec("systemctl", "daemon-reload")
+	h.Exec("systemctl", "start", "kubelet.service")
+
+	d := units("kubelet.service.d_limits.conf", "[Service]\nLimitNOFILE=65536\n")
+	d.RestartPolicy = map[string]string{"kubelet.service.d_limits.conf": "try-restart"}
+	got := mustReconcile(t, h, d)
+	assertActions(t, got, map[string]string{"kubelet.service.d_limits.conf": "create"})
+	assertFile(t, h, "/etc/systemd/system/kubelet.service.d/nto-limits.conf", "[Service]\nLimitNOFILE=65536\n")
+	assertCommand(t, h, "systemctl try-restart kubelet.service")
+
+	got = mustReconcile(t, h, units())
+	assertActions(t, got, map[string]string{"kubelet.service.d_limits.conf": "delete"})
+	assertNoFile(t, h, "/etc/systemd/system/kubelet.service.d/nto-limits.conf")
+	assertFile(t, h, "/etc/systemd/system/kubelet.service", installedService)
+}
+
+func TestReconcileFiles(t *testing.T) {
+	h := fakehost.New()
+	script := kclient.File{
+		Path:    "/usr/local/libexec/nto/a.sh",
+		Mode:    0755,
+		Owner:   "root:root",
+		Content: "#!/bin/sh\n",
+		Units:   []string{"a.service"},
+	}
+	d := units("a.service", installedService)
+	d.Files = map[string]kclient.File{script.Path: script}
+
+	// the unit that depends on the file is created in the same reconcile
+	got := mustReconcile(t, h, d)
+	assertActions(t, got, map[string]string{"a.service": "create", script.Path: "create"})
+	assertFile(t, h, script.Path, script.Content)
+	if f, _ := h.File(script.Path); f.Mode != 0755 {
+		t.Errorf("mode = %04o, want 0755", f.Mode)
+	}
+	assertState(t, h, "nto-a.service", true, "active")
+	assertFile(t, h, "/var/lib/nto/files", script.Path+"\n")
+
+	script.Content = "#!/bin/sh\nexit 0\n"
+	d.Files = map[string]kclient.File{script.Path: script}
+	got = mustReconcile(t, h, d)
+	assertActions(t, got, map[string]string{script.Path: "update"})
+	assertCommand(t, h, "systemctl try-restart nto-a.service")
+
+	got = mustReconcile(t, h, units("a.service", installedService))
+	assertActions(t, got, map[string]string{script.Path: "delete"})
+	assertNoFile(t, h, script.Path)
+	assertFile(t, h, "/var/lib/nto/files", "")
+}
+
+func TestReconcileFilesRefused(t *testing.T) {
+	h := fakehost.New()
+	h.SetFile("/etc/default/nto-a", "A=1\n", 0644)
+	file := func(path, owner string) kclient.File {
+		return kclient.File{Path: path, Mode: 0644, Owner: owner, Content: "A=2\n"}
+	}
+	d := units()
+	d.Files = map[string]kclient.File{
+		"/etc/default/nto-a":       file("/etc/default/nto-a", "root:root"),
+		"/etc/sudoers":             file("/etc/sudoers", "root:root"),
+		"/usr/local/libexec/nto/b": file("/usr/local/libexec/nto/b", "root;reboot"),
+		"/usr/local/libexec/nto/c": file("/usr/local/libexec/nto/c", "nobody:nogroup"),
+	}
+
+	got, err := reconcile(t, h, d)
+	if err == nil {
+		t.Error("Reconcile() expected an error")
+	}
+	assertActions(t, got, map[string]string{
+		"/etc/default/nto-a":       "create failed rolled back",
+		"/etc/sudoers":             "create failed rolled back",
+		"/usr/local/libexec/nto/b": "create failed rolled back",
+		"/usr/local/libexec/nto/c": "create",
+	})
+	// the unmanaged file is left untouched and isn't taken over by a next reconcile
+	assertFile(t, h, "/etc/default/nto-a", "A=1\n")
+	assertNoFile(t, h, "/etc/sudoers")
+	assertNoFile(t, h, "/usr/local/libexec/nto/b")
+	assertFile(t, h, "/var/lib/nto/files", "/usr/local/libexec/nto/c\n")
+	got, _ = reconcile(t, h, d)
+	if got["/etc/default/nto-a"] != "create failed rolled back" {
+		t.Errorf("/etc/default/nto-a = %q, want create failed rolled back", got["/etc/default/nto-a"])
+	}
+	assertFile(t, h, "/etc/default/nto-a", "A=1\n")
+}
+
+func TestReconcileMount(t *testing.T) {
+	h := fakehost.New()
+	mount := "[Mount]\nWhat=/dev/sdb\nWhere=/mnt/data\n"
+	automount := "[Automount]\nWhere=/mnt/data\n\n[Install]\nWantedBy=multi-user.target\n"
+
+	got := mustReconcile(t, h, units("mnt-data.mount", mount, "mnt-data.automount", automount))
+	assertActions(t, got, map[string]string{"mnt-data.automount": "create"})
+	assertFile(t, h, "/etc/systemd/system/mnt-data.mount", mount)
+	assertState(t, h, "mnt-data.automount", true, "active")
+
+	got = mustReconcile(t, h, units("mnt-data.mount", mount, "mnt-data.automount", automount))
+	assertActions(t, got, map[string]string{})
+
+	got = mustReconcile(t, h, units())
+	assertActions(t, got, map[string]string{"mnt-data.automount": "delete"})
+	assertNoFile(t, h, "/etc/systemd/system/mnt-data.mount")
+	assertNoFile(t, h, "/etc/systemd/system/mnt-data.automount")
+}
+
+func TestReconcileMountUnmanaged(t *testing.T) {
+	h := fakehost.New()
+	hostMount := "[Mount]\nWhat=/dev/sda2\nWhere=/mnt/data\n"
+	h.SetFile("/etc/systemd/system/mnt-data.mount", hostMount, 0644)
+	mount := "[Mount]\nWhat=/dev/sdb\nWhere=/mnt/data\n"
+	automount := "[Automount]\nWhere=/mnt/data\n\n[Install]\nWantedBy=multi-user.target\n"
+
+	// the mount unit of the host isn't taken over, not even by a next reconcile
+	for i := 0; i < 2; i++ {
+		got, err := reconcile(t, h, units("mnt-data.mount", mount, "mnt-data.automount", automount))
+		if err == nil {
+			t.Error("Reconcile() expected an error")
+		}
+		assertActions(t, got, map[string]string{"mnt-data.automount": "create failed rolled back"})
+		assertFile(t, h, "/etc/systemd/system/mnt-data.mount", hostMount)
+		assertNoFile(t, h, "/etc/systemd/system/mnt-data.automount")
+		assertNoFile(t, h, "/var/lib/nto/units")
+	}
+}
+
+func TestReconcileRollback(t *testing.T) {
+	h := fakehost.New()
+	d := units("a.service", installedService)
+	d.RestartPolicy = map[string]string{"a.service": "restart"}
+	mustReconcile(t, h, d)
+
+	// a failing restart restores the previous version
+	h.FailOn("systemctl restart nto-a.service")
+	d.Units["a.service"] = strings.Replace(installedService, "infinity", "60", 1)
+	got, err := reconcile(t, h, d)
+	if err == nil {
+		t.Error("Reconcile() expected an error")
+	}
+	assertActions(t, got, map[string]string{"a.service": "update failed rolled back"})
+	assertFile(t, h, "/etc/systemd/system/nto-a.service", installedService)
+	assertState(t, h, "nto-a.service", true, "active")
+
+	// a failing start removes the created unit
+	h.FailOn("systemctl start nto-b.service")
+	d.Units["b.service"] = installedService
+	got, err = reconcile(t, h, d)
+	if err == nil {
+		t.Error("Reconcile() expected an error")
+	}
+	if got["b.service"] != "create failed rolled back" {
+		t.Errorf("b.service = %q, want create failed rolled back", got["b.service"])
+	}
+	assertNoFile(t, h, "/etc/systemd/system/nto-b.service")
+	assertState(t, h, "nto-b.service", false, "inactive")
+	if p := h.Paths("/var/tmp/nto-backup/*"); len(p) > 0 {
+		t.Errorf("backups left: %v", p)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	h := fakehost.New()
+	secret := kclient.File{
+		Path:    "/etc/default/nto-a.env",
+		Mode:    0600,
+		Owner:   "root:root",
+		Content: "TOKEN=\"hunter2\"\n",
+		Secret:  true,
+	}
+	d := units("a.service", installedService)
+	d.Files = map[string]kclient.File{secret.Path: secret}
+	mustReconcile(t, h, d)
+	before := len(h.Commands())
+
+	out := captureStdout(t, func() {
+		op := NewLocal(h, "nto", fakehost.SystemDir, true)
+		_, err := op.Reconcile(&kclient.Node{Address: "10.0.0.1", Desired: units("b.service", installedService)})
+		if err != nil {
+			t.Errorf("Reconcile() error = %v", err)
+		}
+	})
+
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("secret printed:\n%s", out)
+	}
+	for _, want := range []string{"+ExecStart=/usr/bin/sleep infinity", "sudo systemctl enable nto-b.service",
+		"sudo systemctl stop nto-a.service", "# /etc/default/nto-a.env removed"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"cp -p", "test -e", "rm -rf"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("output contains %q:\n%s", unwanted, out)
+		}
+	}
+	for _, c := range h.Commands()[before:] {
+		if strings.HasPrefix(c, "write") || strings.HasPrefix(c, "rm") || strings.HasPrefix(c, "systemctl enable") {
+			t.Errorf("host changed by %q", c)
+		}
+	}
+}
+
+// AssertCommand checks that cmd has been run on h.
+func assertCommand(t *testing.T, h *fakehost.Host, cmd string) {
+	t.Helper()
+	for _, c := range h.Commands() {
+		if c == cmd {
+			return
+		}
+	}
+	t.Errorf("command %q not run", cmd)
+}
+
+// CaptureStdout returns what fn writes to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	fn()
+	os.Stdout = stdout
+	w.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
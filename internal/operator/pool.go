@@ -0,0 +1,264 @@
+package operator
+
+import (
+	"github.com/golang/glog"
+	"github.com/mmlt/systemd-operator/internal/kclient"
+	"os"
+	"sync"
+	"time"
+)
+
+// A pool keeps the SSH connections to nodes open between reconciles, resyncs of many nodes don't need a handshake
+// (and an auth log entry) per node.
+// Idle connections are checked every keepAlive, which also keeps NAT and firewall state alive, and closed when they
+// haven't been used for idleTimeout. A connection is checked before it's reused and redialed when it's broken.
+// Connections are keyed by address and pinned host key, a changed pin results in a new (verified) connection.
+// A check sends an SSH keepalive request and fails when there's no reply within checkTimeout, a half-open connection
+// would otherwise block the check until TCP gives up.
+
+// checkTimeout is the maximum time to wait for the reply to a connection check.
+const checkTimeout = 10 * time.Second
+
+// KeepAliver is a Transport that can check its connection without running a command.
+type keepAliver interface {
+	// KeepAlive sends a request that the host must reply to.
+	KeepAlive() error
+}
+
+// Pool is a set of connections to nodes.
+type pool struct {
+	dial        func(node *kclient.Node) (Transport, error)
+	idleTimeout time.Duration
+	keepAlive   time.Duration
+	// checkTimeout is the maximum time a connection check takes.
+	checkTimeout time.Duration
+
+	mu sync.Mutex
+	// idle contains the connections that aren't in use by key, a nil value is a connection that's in use.
+	idle map[string]*pooledConn
+	stop chan struct{}
+}
+
+// PooledConn is a connection of a pool.
+type pooledConn struct {
+	Transport
+	pool *pool
+	key  string
+	// lastUsed is the time the connection was returned to the pool.
+	lastUsed time.Time
+	// broken is true when a command failed because of the connection.
+	broken bool
+}
+
+// NewPool returns a pool that dials connections with dial.
+func newPool(dial func(node *kclient.Node) (Transport, error), idleTimeout, keepAlive time.Duration) *pool {
+	p := &pool{
+		dial:         dial,
+		idleTimeout:  idleTimeout,
+		keepAlive:    keepAlive,
+		checkTimeout: checkTimeout,
+		idle:         make(map[string]*pooledConn),
+		stop:         make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// SetPool keeps SSH connections open for idleTimeout after a reconcile and checks them every keepAlive.
+// An idleTimeout of 0 closes connections after each reconcile.
+func (op *operator) SetPool(idleTimeout, keepAlive time.Duration) {
+	if op.pool != nil {
+		op.pool.close()
+		op.pool = nil
+	}
+	op.dial = op.dialSSH
+	if idleTimeout <= 0 {
+		return
+	}
+	op.pool = newPool(op.dialSSH, idleTimeout, keepAlive)
+	op.dial = op.pool.get
+}
+
+// Close closes the pooled connections.
+func (op *operator) Close() {
+	if op.pool != nil {
+		op.pool.close()
+	}
+}
+
+// Get returns an idle connection to node or dials a new one.
+// The connection is returned to the pool by closing it.
+func (p *pool) get(node *kclient.Node) (Transport, error) {
+	key := node.Address + " " + node.HostKey
+
+	p.mu.Lock()
+	c := p.idle[key]
+	p.idle[key] = nil
+	p.mu.Unlock()
+
+	if c != nil {
+		if c.healthy() {
+			return c, nil
+		}
+		glog.V(2).Infof("node %s: connection broken, redial", node.Address)
+		c.Transport.Close()
+	}
+
+	t, err := p.dial(node)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{Transport: t, pool: p, key: key}, nil
+}
+
+// Close closes the idle connections and stops the keepalives.
+// Connections that are in use are closed when they're returned.
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.stop:
+		return
+	default:
+	}
+	close(p.stop)
+	for _, c := range p.idle {
+		if c != nil {
+			c.Transport.Close()
+		}
+	}
+	p.idle = make(map[string]*pooledConn)
+}
+
+// Run checks the idle connections every keepAlive until the pool is closed.
+func (p *pool) run() {
+	interval := p.keepAlive
+	if interval <= 0 {
+		interval = p.idleTimeout
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			p.check()
+		}
+	}
+}
+
+// Check closes the idle connections that timed out or are broken.
+func (p *pool) check() {
+	p.mu.Lock()
+	var conns []*pooledConn
+	for _, c := range p.idle {
+		if c != nil {
+			conns = append(conns, c)
+		}
+	}
+	p.idle = make(map[string]*pooledConn)
+	p.mu.Unlock()
+
+	// connections are checked in parallel without holding the lock as a check takes a round trip
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *pooledConn) {
+			defer wg.Done()
+			if time.Since(c.lastUsed) > p.idleTimeout || (p.keepAlive > 0 && !c.healthy()) {
+				c.Transport.Close()
+				return
+			}
+			p.put(c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// Put returns c to the pool, when the pool already has a connection with the same key c is closed.
+func (p *pool) put(c *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.stop:
+		c.Transport.Close()
+		return
+	default:
+	}
+	if p.idle[c.key] != nil {
+		c.Transport.Close()
+		return
+	}
+	p.idle[c.key] = c
+}
+
+// Healthy returns true when the host replies within checkTimeout.
+// An unhealthy connection must be closed, which ends a check that's still waiting for a reply.
+func (c *pooledConn) healthy() bool {
+	done := make(chan error, 1)
+	go func() {
+		if k, ok := c.Transport.(keepAliver); ok {
+			done <- k.KeepAlive()
+			return
+		}
+		_, err := c.Transport.Exec("true")
+		done <- err
+	}()
+	t := time.NewTimer(c.pool.checkTimeout)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-t.C:
+		glog.V(2).Infof("connection %s: no reply within %s", c.key, c.pool.checkTimeout)
+		return false
+	}
+}
+
+// Exec runs a command and marks the connection broken when the command couldn't be run.
+func (c *pooledConn) Exec(cmd string, args ...string) (string, error) {
+	s, err := c.Transport.Exec(cmd, args...)
+	c.observe(err)
+	return s, err
+}
+
+// WriteFile replaces a file and marks the connection broken when the command couldn't be run.
+func (c *pooledConn) WriteFile(path string, data []byte, mode os.FileMode) error {
+	err := c.Transport.WriteFile(path, data, mode)
+	c.observe(err)
+	return err
+}
+
+// ReadFile returns the content of a file and marks the connection broken when the command couldn't be run.
+func (c *pooledConn) ReadFile(path string) (string, error) {
+	s, err := c.Transport.ReadFile(path)
+	if !os.IsNotExist(err) {
+		c.observe(err)
+	}
+	return s, err
+}
+
+// RemoveFile removes a file and marks the connection broken when the command couldn't be run.
+func (c *pooledConn) RemoveFile(path string) error {
+	err := c.Transport.RemoveFile(path)
+	c.observe(err)
+	return err
+}
+
+// Observe marks the connection broken when err isn't the exit status of a command.
+func (c *pooledConn) observe(err error) {
+	if _, ok := exitStatus(err); err != nil && !ok {
+		c.broken = true
+	}
+}
+
+// Close returns the connection to the pool or closes it when it's broken.
+func (c *pooledConn) Close() {
+	if c.broken {
+		c.Transport.Close()
+		return
+	}
+	c.lastUsed = time.Now()
+	c.pool.put(c)
+}
@@ -0,0 +1,236 @@
+package operator
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/kclient"
+	"os"
+	"testing"
+	"time"
+)
+
+// FakeConn is a Transport that fails all commands with err.
+// When block is set commands hang until the connection is closed, like commands on a half-open connection.
+type fakeConn struct {
+	err    error
+	block  chan struct{}
+	closed bool
+}
+
+func (c *fakeConn) Exec(cmd string, args ...string) (string, error) {
+	if c.block != nil {
+		<-c.block
+		return "", errBroken
+	}
+	return "", c.err
+}
+
+func (c *fakeConn) WriteFile(path string, data []byte, mode os.FileMode) error { return c.err }
+
+func (c *fakeConn) ReadFile(path string) (string, error) { return "", c.err }
+
+func (c *fakeConn) RemoveFile(path string) error { return c.err }
+
+func (c *fakeConn) Close() {
+	if c.block != nil {
+		close(c.block)
+	}
+	c.closed = true
+}
+
+// ExitErr is the error of a command that exits with a non-zero status.
+type exitErr int
+
+func (e exitErr) Error() string { return fmt.Sprintf("Process exited with status %d", int(e)) }
+
+func (e exitErr) ExitStatus() int { return int(e) }
+
+var (
+	errExit   = exitErr(1)
+	errBroken = errors.New("connection reset by peer")
+)
+
+// NewTestPool returns a pool that doesn't check connections by itself and the connections it dialed.
+func newTestPool(t *testing.T) (*pool, *[]*fakeConn) {
+	var dialed []*fakeConn
+	p := newPool(func(node *kclient.Node) (Transport, error) {
+		c := &fakeConn{}
+		dialed = append(dialed, c)
+		return c, nil
+	}, time.Hour, time.Hour)
+	t.Cleanup(p.close)
+	return p, &dialed
+}
+
+func mustGet(t *testing.T, p *pool, node *kclient.Node) *pooledConn {
+	t.Helper()
+	c, err := p.get(node)
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	return c.(*pooledConn)
+}
+
+func assertDialed(t *testing.T, dialed *[]*fakeConn, n int) {
+	t.Helper()
+	if len(*dialed) != n {
+		t.Errorf("dialed %d connections, want %d", len(*dialed), n)
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	p, dialed := newTestPool(t)
+	node := &kclient.Node{Address: "10.0.0.1"}
+
+	c := mustGet(t, p, node)
+	c.Close()
+	if got := mustGet(t, p, node); got != c {
+		t.Error("get() didn't reuse the idle connection")
+	}
+	assertDialed(t, dialed, 1)
+
+	// a command that exits with an error doesn't break the connection
+	(*dialed)[0].err = errExit
+	if _, err := c.Exec("false"); err == nil {
+		t.Fatal("Exec() expected an error")
+	}
+	(*dialed)[0].err = nil
+	c.Close()
+	if got := mustGet(t, p, node); got != c {
+		t.Error("get() didn't reuse the connection after a failed command")
+	}
+	c.Close()
+
+	// a different pin gets its own connection
+	other := mustGet(t, p, &kclient.Node{Address: "10.0.0.1", HostKey: "SHA256:x"})
+	if other == c {
+		t.Error("get() returned the connection of another host key")
+	}
+	assertDialed(t, dialed, 2)
+}
+
+func TestPoolIdleExpiry(t *testing.T) {
+	p, dialed := newTestPool(t)
+	node := &kclient.Node{Address: "10.0.0.1"}
+
+	c := mustGet(t, p, node)
+	c.Close()
+	p.check()
+	if (*dialed)[0].closed {
+		t.Fatal("check() closed a connection that didn't time out")
+	}
+
+	c.lastUsed = time.Now().Add(-2 * p.idleTimeout)
+	p.check()
+	if !(*dialed)[0].closed {
+		t.Error("check() didn't close the timed out connection")
+	}
+	if got := mustGet(t, p, node); got == c {
+		t.Error("get() returned the timed out connection")
+	}
+	assertDialed(t, dialed, 2)
+}
+
+func TestPoolBroken(t *testing.T) {
+	p, dialed := newTestPool(t)
+	node := &kclient.Node{Address: "10.0.0.1"}
+
+	// a connection that failed while in use is closed when it's returned
+	c := mustGet(t, p, node)
+	(*dialed)[0].err = errBroken
+	c.Exec("true")
+	c.Close()
+	if !(*dialed)[0].closed {
+		t.Error("Close() didn't close the broken connection")
+	}
+	if got := mustGet(t, p, node); got == c {
+		t.Error("get() returned the broken connection")
+	}
+	assertDialed(t, dialed, 2)
+
+	// an idle connection that broke is redialed by get
+	c = mustGet(t, p, &kclient.Node{Address: "10.0.0.2"})
+	c.Close()
+	(*dialed)[2].err = errBroken
+	if got := mustGet(t, p, &kclient.Node{Address: "10.0.0.2"}); got == c {
+		t.Error("get() returned the unhealthy connection")
+	}
+	if !(*dialed)[2].closed {
+		t.Error("get() didn't close the unhealthy connection")
+	}
+	assertDialed(t, dialed, 4)
+
+	// an idle connection that broke is closed by check
+	c = mustGet(t, p, &kclient.Node{Address: "10.0.0.3"})
+	c.Close()
+	(*dialed)[4].err = errBroken
+	p.check()
+	if !(*dialed)[4].closed {
+		t.Error("check() didn't close the unhealthy connection")
+	}
+}
+
+func TestPoolHalfOpen(t *testing.T) {
+	p, dialed := newTestPool(t)
+	p.checkTimeout = 10 * time.Millisecond
+
+	// a connection that doesn't reply is closed by check
+	c := mustGet(t, p, &kclient.Node{Address: "10.0.0.1"})
+	c.Close()
+	(*dialed)[0].block = make(chan struct{})
+	p.check()
+	if !(*dialed)[0].closed {
+		t.Error("check() didn't close the connection that didn't reply")
+	}
+
+	// a connection that doesn't reply is redialed by get
+	c = mustGet(t, p, &kclient.Node{Address: "10.0.0.2"})
+	c.Close()
+	(*dialed)[1].block = make(chan struct{})
+	if got := mustGet(t, p, &kclient.Node{Address: "10.0.0.2"}); got == c {
+		t.Error("get() returned the connection that didn't reply")
+	}
+	if !(*dialed)[1].closed {
+		t.Error("get() didn't close the connection that didn't reply")
+	}
+	assertDialed(t, dialed, 3)
+}
+
+func TestPoolInUse(t *testing.T) {
+	p, dialed := newTestPool(t)
+	node := &kclient.Node{Address: "10.0.0.1"}
+	key := node.Address + " " + node.HostKey
+
+	c := mustGet(t, p, node)
+	if v, ok := p.idle[key]; !ok || v != nil {
+		t.Errorf("idle[%q] = %v, %t, want the in use marker", key, v, ok)
+	}
+	p.check()
+	if _, ok := p.idle[key]; ok {
+		t.Errorf("check() didn't reset the in use marker")
+	}
+
+	// a second connection to the same node is closed when it's returned after the first
+	c2 := mustGet(t, p, node)
+	assertDialed(t, dialed, 2)
+	c.Close()
+	c2.Close()
+	if (*dialed)[0].closed || !(*dialed)[1].closed {
+		t.Errorf("closed = %t, %t, want false, true", (*dialed)[0].closed, (*dialed)[1].closed)
+	}
+	if got := mustGet(t, p, node); got != c {
+		t.Error("get() didn't return the first connection")
+	}
+	c.Close()
+
+	// returning a connection to a closed pool closes it
+	c3 := mustGet(t, p, &kclient.Node{Address: "10.0.0.2"})
+	p.close()
+	if !(*dialed)[0].closed {
+		t.Error("close() didn't close the idle connection")
+	}
+	c3.Close()
+	if !(*dialed)[2].closed {
+		t.Error("Close() didn't close the connection of a closed pool")
+	}
+}
@@ -0,0 +1,29 @@
+package operator
+
+import (
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/systemctl"
+)
+
+// restartCmds maps a restart policy to the systemctl command that applies it.
+// A policy that's not in the map, like 'none', doesn't run a command.
+var restartCmds = map[string]systemctl.UnitCmd{
+	"reload":            systemctl.Reload,
+	"restart":           systemctl.Restart,
+	"try-restart":       systemctl.TryRestart,
+	"reload-or-restart": systemctl.ReloadOrRestart,
+}
+
+// RestartUnit applies a restart policy to a unit of which the configuration has changed.
+// Policy is one of none (or ""), reload, restart, try-restart or reload-or-restart.
+func restartUnit(sc *systemctl.SystemCtl, name, policy string) error {
+	if policy == "" || policy == "none" {
+		return nil
+	}
+	cmd, ok := restartCmds[policy]
+	if !ok {
+		return fmt.Errorf("unknown restart policy %q", policy)
+	}
+	_, err := sc.Unit(cmd, name)
+	return err
+}
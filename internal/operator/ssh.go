@@ -0,0 +1,93 @@
+package operator
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// sshDialTimeout is the maximum time to establish an SSH connection.
+const sshDialTimeout = 30 * time.Second
+
+// SshClient is a stager that runs commands on a remote host via SSH.
+type sshClient struct {
+	client *ssh.Client
+}
+
+// DialSSH returns a Transport to address via SSH.
+// When key is set the user is authenticated with key and pass is the key pass-phrase, otherwise pass is the password.
+// HostKey verifies the host key, see hostKeyVerifier.
+func DialSSH(address, user, pass, key string, hostKey ssh.HostKeyCallback) (Transport, error) {
+	var auth ssh.AuthMethod
+	if key != "" {
+		var signer ssh.Signer
+		var err error
+		if pass != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(key), []byte(pass))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(key))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse key: %v", err)
+		}
+		auth = ssh.PublicKeys(signer)
+	} else {
+		auth = ssh.Password(pass)
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKey,
+		Timeout:         sshDialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &hostTransport{&sshClient{client: client}}, nil
+}
+
+// Exec runs a command in a new session.
+// A non-zero exit status results in an *ssh.ExitError.
+func (c *sshClient) Exec(cmd string, args ...string) (string, error) {
+	s, err := c.client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+	b, err := s.CombinedOutput(strings.Join(append([]string{cmd}, args...), " "))
+	return string(b), err
+}
+
+// ScpTo writes data to a file with path and mode.
+func (c *sshClient) ScpTo(data []byte, path string, mode os.FileMode) error {
+	s, err := c.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.Stdin = bytes.NewReader(data)
+	b, err := s.CombinedOutput(fmt.Sprintf("umask 077 && cat > %s && chmod %04o %s", path, mode, path))
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// KeepAlive sends a keepalive request, the reply shows the connection works without the overhead of a session.
+func (c *sshClient) KeepAlive() error {
+	_, _, err := c.client.SendRequest("keepalive@openssh.com", true, nil)
+	return err
+}
+
+// Close closes the connection.
+func (c *sshClient) Close() {
+	c.client.Close()
+}
@@ -0,0 +1,184 @@
+package operator
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/mmlt/systemd-operator/internal/kclient"
+	"github.com/mmlt/systemd-operator/internal/systemctl"
+	"path"
+	"strings"
+)
+
+// Transaction makes the transition of a unit all-or-nothing.
+// Before a file is written or removed its previous version is backed up, before a unit is enabled, started, etc. the
+// inverse operation is recorded. When a step fails, rollback undoes the recorded operations in reverse order.
+type transaction struct {
+	cl Transport
+	// dir is the directory the unit files are in.
+	dir string
+	// backupDir is the directory on the host where previous versions of files are kept during the transaction.
+	backupDir string
+	// backedUp contains the files that have been backed up.
+	backedUp map[string]bool
+	// undo contains the operations that revert the steps taken so far.
+	undo []func() error
+}
+
+// Begin starts a transaction on the files in dir.
+func (op *operator) begin(cl Transport, dir string) *transaction {
+	return &transaction{
+		cl:        cl,
+		dir:       dir,
+		backupDir: "/var/tmp/" + op.prefix + "backup",
+		backedUp:  make(map[string]bool),
+	}
+}
+
+// Finish commits the transaction when err is nil, otherwise it's rolled back.
+// It returns the outcome of performing action a on file name.
+func (op *operator) finish(t *transaction, name string, a action, localHash map[string]string, err error) kclient.UnitResult {
+	if err == nil {
+		if e := t.commit(); e != nil {
+			glog.Warningf("remove backup: %v", e)
+		}
+		return op.unitResult(name, a, localHash, nil)
+	}
+
+	rbErr := t.rollback()
+	if rbErr != nil {
+		err = fmt.Errorf("%v; rollback failed: %v", err, rbErr)
+	}
+	r := op.unitResult(name, a, localHash, err)
+	r.RolledBack = rbErr == nil
+	return r
+}
+
+// OnRollback records fn to be called when the transaction is rolled back.
+func (t *transaction) onRollback(fn func() error) {
+	t.undo = append(t.undo, fn)
+}
+
+// Backup saves the current version of file name, relative to dir, so it can be restored by rollback.
+// When the file doesn't exist rollback removes it.
+func (t *transaction) backup(name string) error {
+	if t.backedUp[name] {
+		return nil
+	}
+	t.backedUp[name] = true
+
+	fn := path.Join(t.dir, name)
+	bak := path.Join(t.backupDir, strings.Replace(name, "/", "_", -1))
+	// test with sudo, a file that the user can't stat would otherwise be removed by rollback
+	_, err := t.cl.Exec("sudo", "test", "-e", fn)
+	if err != nil {
+		if s, ok := exitStatus(err); !ok || s != 1 {
+			return fmt.Errorf("backup %s: %v", fn, err)
+		}
+		// the file doesn't exist
+		t.onRollback(func() error {
+			_, err := t.cl.Exec("sudo", "rm", "-f", fn)
+			return err
+		})
+		return nil
+	}
+	_, err = t.cl.Exec("sudo", "mkdir", "-p", t.backupDir)
+	if err != nil {
+		return err
+	}
+	_, err = t.cl.Exec("sudo", "cp", "-p", fn, bak)
+	if err != nil {
+		return fmt.Errorf("backup %s: %v", fn, err)
+	}
+	t.onRollback(func() error {
+		_, err := t.cl.Exec("sudo", "mv", bak, fn)
+		return err
+	})
+	return nil
+}
+
+// CopyFile backs up file name and replaces it with data.
+func (t *transaction) copyFile(name string, data []byte) error {
+	err := t.backup(name)
+	if err != nil {
+		return err
+	}
+	return copyFile(t.cl, t.dir, name, data)
+}
+
+// CopySecret is like copyFile for a file that must only be readable by root.
+func (t *transaction) copySecret(name string, data []byte) error {
+	err := t.backup(name)
+	if err != nil {
+		return err
+	}
+	return copyFileMode(t.cl, t.dir, name, data, 0600)
+}
+
+// DeleteFile backs up file name and removes it.
+func (t *transaction) deleteFile(name string) error {
+	err := t.backup(name)
+	if err != nil {
+		return err
+	}
+	return deleteFile(t.cl, t.dir, name)
+}
+
+// Unit runs a systemctl unit command and records undo to be run when the transaction is rolled back.
+func (t *transaction) unit(cmd, undo systemctl.UnitCmd, name string) error {
+	_, err := systemctl.New(t.cl).Unit(cmd, name)
+	if err != nil {
+		return err
+	}
+	t.onRollback(func() error {
+		_, err := systemctl.New(t.cl).Unit(undo, name)
+		return err
+	})
+	return nil
+}
+
+// UnitFile runs a systemctl unit file command and records undo to be run when the transaction is rolled back.
+func (t *transaction) unitFile(cmd, undo systemctl.UnitFileCmd, name string) error {
+	_, err := systemctl.New(t.cl).UnitFile(cmd, name)
+	if err != nil {
+		return err
+	}
+	t.onRollback(func() error {
+		_, err := systemctl.New(t.cl).UnitFile(undo, name)
+		return err
+	})
+	return nil
+}
+
+// Rollback undoes the steps of the transaction in reverse order and reloads the systemd configuration.
+// All steps are attempted, the first error is returned.
+func (t *transaction) rollback() error {
+	var first error
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		if err := t.undo[i](); err != nil && first == nil {
+			first = err
+		}
+	}
+	t.undo = nil
+	_, err := systemctl.New(t.cl).DaemonReload()
+	if err != nil && first == nil {
+		first = err
+	}
+	if first == nil {
+		t.removeBackups()
+	}
+	return first
+}
+
+// Commit ends the transaction by removing the backups.
+func (t *transaction) commit() error {
+	t.undo = nil
+	return t.removeBackups()
+}
+
+func (t *transaction) removeBackups() error {
+	if len(t.backedUp) == 0 {
+		return nil
+	}
+	_, err := t.cl.Exec("sudo", "rm", "-rf", t.backupDir)
+	return err
+}
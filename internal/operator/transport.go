@@ -0,0 +1,108 @@
+package operator
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/shclient"
+	"os"
+	"path"
+)
+
+// Transport runs commands and manages files on a host.
+// Files are written, read and removed as root.
+type Transport interface {
+	// Exec runs a command with arguments, the arguments can contain shell globs.
+	// A non-zero exit status results in an error with an ExitStatus() int method, see exitStatus.
+	Exec(cmd string, args ...string) (string, error)
+	// WriteFile replaces the file at path with data, the file is owned by root:root and has mode.
+	WriteFile(path string, data []byte, mode os.FileMode) error
+	// ReadFile returns the content of the file at path.
+	// An error for which os.IsNotExist returns true is returned when the file doesn't exist.
+	ReadFile(path string) (string, error)
+	// RemoveFile removes the file at path, it's not an error when the file doesn't exist.
+	RemoveFile(path string) error
+	// Close releases the connection to the host.
+	Close()
+}
+
+// ExitStatus returns the exit status of a command that ran and exited with a non-zero status.
+// It returns false when err isn't an exit status, for example when the command couldn't be run because the connection
+// to the host broke.
+func exitStatus(err error) (int, bool) {
+	var e interface{ ExitStatus() int }
+	if errors.As(err, &e) {
+		return e.ExitStatus(), true
+	}
+	return 0, false
+}
+
+// Stager is a client that runs commands and copies files to a host without privileges.
+// Both sshClient and shclient are stagers.
+type stager interface {
+	Exec(cmd string, args ...string) (string, error)
+	ScpTo(data []byte, path string, mode os.FileMode) error
+	Close()
+}
+
+// HostTransport is a Transport that uses sudo to install the files that a stager copies to a temporary location.
+type hostTransport struct {
+	stager
+}
+
+// NewLocalTransport returns a Transport to the host the process runs on.
+func NewLocalTransport() Transport {
+	return &hostTransport{shclient.NewSH()}
+}
+
+// NewNsenterTransport returns a Transport to the host from a privileged container with hostPID.
+func NewNsenterTransport() Transport {
+	return &hostTransport{shclient.NewNsenter()}
+}
+
+// WriteFile copies data to a temporary file and moves it into place.
+// The temporary file is created with mode so its content isn't readable by others when mode doesn't allow it.
+func (t *hostTransport) WriteFile(name string, data []byte, mode os.FileMode) error {
+	fn := "/var/tmp/" + path.Base(name) // temporary file location
+	err := t.ScpTo(data, fn, mode)
+	if err != nil {
+		return fmt.Errorf("scp %s: %w", fn, err)
+	}
+	_, err = t.Exec("sudo", "chown", "root:root", fn)
+	if err != nil {
+		return err
+	}
+	_, err = t.Exec("sudo", "mv", fn, name)
+	return err
+}
+
+// ReadFile returns the content of a file.
+func (t *hostTransport) ReadFile(name string) (string, error) {
+	_, err := t.Exec("sudo", "test", "-e", name)
+	if err != nil {
+		if s, ok := exitStatus(err); ok && s == 1 {
+			return "", &os.PathError{Op: "read", Path: name, Err: os.ErrNotExist}
+		}
+		return "", err
+	}
+	s, err := t.Exec("sudo", "cat", name)
+	if err != nil {
+		return "", fmt.Errorf("cat %s: %w", name, err)
+	}
+	return s, nil
+}
+
+// KeepAlive checks the connection of the stager, it runs a command when the stager can't check the connection by
+// itself.
+func (t *hostTransport) KeepAlive() error {
+	if k, ok := t.stager.(keepAliver); ok {
+		return k.KeepAlive()
+	}
+	_, err := t.Exec("true")
+	return err
+}
+
+// RemoveFile removes a file.
+func (t *hostTransport) RemoveFile(name string) error {
+	_, err := t.Exec("sudo", "rm", "-f", name)
+	return err
+}
@@ -0,0 +1,30 @@
+package operator
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantOk     bool
+	}{
+		{name: "nil"},
+		{name: "broken connection", err: errBroken},
+		{name: "exit status", err: exitErr(2), wantStatus: 2, wantOk: true},
+		{name: "wrapped exit status", err: fmt.Errorf("cat /etc/a: %w", exitErr(1)), wantStatus: 1, wantOk: true},
+		{name: "text only", err: errors.New("Process exited with status 1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ok := exitStatus(tt.err)
+			if s != tt.wantStatus || ok != tt.wantOk {
+				t.Errorf("exitStatus() = %d, %t, want %d, %t", s, ok, tt.wantStatus, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package operator
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// managedTypes are the unit types managed by the operator.
+var managedTypes = map[string]bool{
+	"service":   true,
+	"timer":     true,
+	"socket":    true,
+	"path":      true,
+	"mount":     true,
+	"automount": true,
+	"target":    true,
+}
+
+// unprefixedTypes are the unit types of which the name isn't prefixed.
+// The name of a mount unit must match its mount point, for example mnt-data.mount mounts /mnt/data.
+var unprefixedTypes = map[string]bool{
+	"mount":     true,
+	"automount": true,
+}
+
+// activates maps the type of an activating unit to the type of the unit it activates.
+var activates = map[string]string{
+	"timer":     "service",
+	"socket":    "service",
+	"path":      "service",
+	"automount": "mount",
+}
+
+// UnitType returns the type of a unit file, for example 'timer' for 'nto-test.timer'.
+func unitType(name string) string {
+	return strings.TrimPrefix(path.Ext(name), ".")
+}
+
+// Activated returns the name of the unit that is activated by unit name or "" when it doesn't activate another unit.
+func activated(name string) string {
+	t, ok := activates[unitType(name)]
+	if !ok {
+		return ""
+	}
+	return strings.TrimSuffix(name, path.Ext(name)) + "." + t
+}
+
+// PrimaryUnits returns the sorted names of the managed units in hash that aren't activated by another unit in hash.
+func primaryUnits(hash map[string]string) []string {
+	isActivated := make(map[string]bool)
+	for n := range hash {
+		if a := activated(n); a != "" {
+			isActivated[a] = true
+		}
+	}
+
+	var result []string
+	for n := range hash {
+		if managedTypes[unitType(n)] && !isActivated[n] && !isDropIn(n) && !isFile(n) {
+			result = append(result, n)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// IsUnprefixed returns true when name is the file name of a unit of which the name isn't prefixed.
+func isUnprefixed(name string) bool {
+	return unprefixedTypes[unitType(name)] && !isDropIn(name) && !isFile(name)
+}
+
+// UnitFiles returns the file of primary unit name and, when present in hash, the file of the unit it activates.
+func unitFiles(name string, hash map[string]string) []string {
+	files := []string{name}
+	if a := activated(name); a != "" {
+		if _, ok := hash[a]; ok {
+			files = append(files, a)
+		}
+	}
+	return files
+}
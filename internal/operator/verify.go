@@ -0,0 +1,66 @@
+package operator
+
+import (
+	"fmt"
+	"github.com/mmlt/systemd-operator/internal/systemctl"
+	"github.com/mmlt/systemd-operator/internal/unitfile"
+	"path"
+	"strings"
+)
+
+// StagingDir returns the directory on the host where unit files are verified before they're installed.
+func (op *operator) stagingDir() string {
+	return "/var/tmp/" + op.prefix + "staging"
+}
+
+// VerifyUnit uploads the files of a unit to dir and checks them with systemd-analyze.
+// The OnCalendar expressions of timers are checked with systemd-analyze calendar.
+// It returns an error containing the systemd-analyze output when a file isn't valid.
+func verifyUnit(cl Transport, dir string, files []string, cm map[string]string) error {
+	_, err := cl.Exec("mkdir", "-p", dir)
+	if err != nil {
+		return err
+	}
+	var staged []string
+	for _, f := range files {
+		fn := path.Join(dir, f)
+		if isTemplate(f) {
+			// a template can only be verified as an instance
+			fn = path.Join(dir, instanceName(f, "verify"))
+		}
+		err = cl.WriteFile(fn, []byte(cm[f]), 0644)
+		if err != nil {
+			return fmt.Errorf("stage %s: %v", fn, err)
+		}
+		staged = append(staged, fn)
+	}
+	defer cl.Exec("rm", append([]string{"-f"}, staged...)...)
+
+	sc := systemctl.New(cl)
+	s, err := sc.Verify(staged...)
+	if err != nil {
+		return fmt.Errorf("verify: %v: %s", err, strings.TrimSpace(s))
+	}
+
+	for _, f := range files {
+		if unitType(f) != "timer" {
+			continue
+		}
+		uf, err := unitfile.Parse(strings.NewReader(cm[f]))
+		if err != nil {
+			return fmt.Errorf("parse %s: %v", f, err)
+		}
+		t := uf.Section("Timer")
+		if t == nil {
+			continue
+		}
+		for _, expr := range t.Values("OnCalendar") {
+			s, err := sc.Calendar(expr)
+			if err != nil {
+				return fmt.Errorf("calendar %q: %v: %s", expr, err, strings.TrimSpace(s))
+			}
+		}
+	}
+
+	return nil
+}
@@ -1,19 +1,91 @@
 package shclient
 
-import "os/exec"
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
 
+// ShClient runs commands on the host it runs on instead of on a remote host via SSH.
+// Commands are run by a shell so arguments can contain globs, like the commands that are run via SSH.
+// When running as root 'sudo' is dropped from commands, a container image doesn't need to have sudo.
 type shClient struct {
-
+	// nsenter is true when commands are run in the namespaces of the host init process.
+	nsenter bool
+	// root is true when the process runs as root.
+	root bool
 }
 
+// NewSH returns a client that runs commands in the namespaces of the current process.
 func NewSH() *shClient {
 	return &shClient{
+		root: os.Geteuid() == 0,
+	}
+}
 
+// NewNsenter returns a client that runs commands in the namespaces of PID 1 of the host.
+// It's used from a privileged container with hostPID so systemctl talks to the systemd of the host and files are
+// written to the host filesystem.
+func NewNsenter() *shClient {
+	return &shClient{
+		nsenter: true,
+		root:    os.Geteuid() == 0,
 	}
 }
 
+// Exec runs a command and returns its output.
+// A non-zero exit status results in an error with an ExitStatus method, like the *ssh.ExitError of the SSH client.
 func (c *shClient) Exec(name string, arg ...string) (string, error) {
-	output, err := exec.Command(name, arg...).CombinedOutput()
+	if name == "sudo" && c.root && len(arg) > 0 {
+		name, arg = arg[0], arg[1:]
+	}
+	return c.run(nil, strings.Join(append([]string{name}, arg...), " "))
+}
+
+// ScpTo writes data to a file with path and mode.
+func (c *shClient) ScpTo(data []byte, path string, mode os.FileMode) error {
+	_, err := c.run(bytes.NewReader(data), fmt.Sprintf("umask 077 && cat > %s && chmod %04o %s", path, mode, path))
+	return err
+}
+
+// Close releases the resources of the client.
+func (c *shClient) Close() {
+}
+
+// Run runs script with stdin as input.
+func (c *shClient) run(stdin io.Reader, script string) (string, error) {
+	var cmd *exec.Cmd
+	if c.nsenter {
+		cmd = exec.Command("nsenter", "--target", "1", "--mount", "--uts", "--ipc", "--net", "--pid", "--",
+			"sh", "-c", script)
+	} else {
+		cmd = exec.Command("sh", "-c", script)
+	}
+	cmd.Stdin = stdin
+	output, err := cmd.CombinedOutput()
+	if e, ok := err.(*exec.ExitError); ok {
+		if ws, ok := e.Sys().(syscall.WaitStatus); ok {
+			err = &exitError{strings.TrimSpace(string(output)), ws.ExitStatus()}
+		}
+	}
 	return string(output), err
 }
 
+// ExitError is the error of a command that ran and exited with a non-zero status.
+type exitError struct {
+	output string
+	status int
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("%s: Process exited with status %d", e.output, e.status)
+}
+
+// ExitStatus returns the exit status of the command.
+func (e *exitError) ExitStatus() int {
+	return e.status
+}
@@ -0,0 +1,19 @@
+package systemctl
+
+import "strings"
+
+// Verify checks unit files for errors, for example an ExecStart binary that doesn't exist.
+// The directories of the files are added to the unit search path so units can refer to each other.
+func (sc *SystemCtl) Verify(files ...string) (string, error) {
+	return sc.systemdAnalyze(append([]string{"verify"}, files...)...)
+}
+
+// Calendar checks a calendar expression as used by OnCalendar= and returns its normalized form.
+func (sc *SystemCtl) Calendar(expr string) (string, error) {
+	// the expression contains spaces and wildcards so it's quoted for the remote shell
+	return sc.systemdAnalyze("calendar", "'"+strings.Replace(expr, "'", `'\''`, -1)+"'")
+}
+
+func (sc *SystemCtl) systemdAnalyze(arg ...string) (string, error) {
+	return sc.cmd.Exec("systemd-analyze", arg...)
+}
@@ -3,6 +3,7 @@ package systemctl
 import (
 	"github.com/mmlt/systemd-operator/internal/tableconv"
 	"strings"
+	"unicode"
 )
 
 // Executer interface is used to perform systemctl commands.
@@ -113,6 +114,8 @@ const (
 	Stop
 	Reload
 	Restart
+	TryRestart
+	ReloadOrRestart
 )
 
 // Unit performs one of:
@@ -120,8 +123,22 @@ const (
 // Stop (deactivate) one or more units
 // Reload one or more units
 // Start or restart one or more units
+// Restart one or more units if active
+// Reload one or more units if possible, otherwise start or restart
 func (sc *SystemCtl) Unit(cmd UnitCmd, name string) (string, error) {
-	return sc.sudoSystemctl(strings.ToLower(cmd.String()), name)
+	return sc.sudoSystemctl(verb(cmd.String()), name)
+}
+
+// Verb converts a command name to a systemctl verb, for example 'TryRestart' to 'try-restart'.
+func verb(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) {
+			b.WriteByte('-')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
 }
 
 // UnitCmd represents the actions to perform on an unit.
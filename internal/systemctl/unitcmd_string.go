@@ -4,9 +4,9 @@ package systemctl
 
 import "strconv"
 
-const _UnitCmd_name = "StartStopReloadRestart"
+const _UnitCmd_name = "StartStopReloadRestartTryRestartReloadOrRestart"
 
-var _UnitCmd_index = [...]uint8{0, 5, 9, 15, 22}
+var _UnitCmd_index = [...]uint8{0, 5, 9, 15, 22, 32, 47}
 
 func (i UnitCmd) String() string {
 	if i < 0 || i >= UnitCmd(len(_UnitCmd_index)-1) {
@@ -0,0 +1,169 @@
+package unitfile
+
+import "strings"
+
+// The directives below are taken from systemd.directives(7).
+// Deprecated directives that systemd still accepts are included.
+
+// unitSections maps unit type to section name to the keys allowed in that section.
+var unitSections = map[string]map[string]map[string]bool{
+	"service": {
+		"Unit":    unitKeys,
+		"Install": installKeys,
+		"Service": keys(serviceKeys, execKeys, killKeys, resourceKeys),
+	},
+	"socket": {
+		"Unit":    unitKeys,
+		"Install": installKeys,
+		"Socket":  keys(socketKeys, execKeys, killKeys, resourceKeys),
+	},
+	"mount": {
+		"Unit":    unitKeys,
+		"Install": installKeys,
+		"Mount":   keys(mountKeys, execKeys, killKeys, resourceKeys),
+	},
+	"automount": {
+		"Unit":      unitKeys,
+		"Install":   installKeys,
+		"Automount": keys(automountKeys),
+	},
+	"timer": {
+		"Unit":    unitKeys,
+		"Install": installKeys,
+		"Timer":   keys(timerKeys),
+	},
+	"path": {
+		"Unit":    unitKeys,
+		"Install": installKeys,
+		"Path":    keys(pathKeys),
+	},
+	"target": {
+		"Unit":    unitKeys,
+		"Install": installKeys,
+	},
+}
+
+// specifiers are the valid characters after a %, see systemd.unit(5).
+var specifiers = func() map[byte]bool {
+	m := make(map[byte]bool)
+	for _, c := range []byte("aAbBCdEfgGhHiIjJlLmMnNopPqsStTuUvVwWyY%") {
+		m[c] = true
+	}
+	return m
+}()
+
+var unitKeys = keys(strings.Fields(`
+	Description Documentation Wants Requires Requisite BindsTo PartOf Upholds Conflicts Before After
+	OnFailure OnSuccess PropagatesReloadTo ReloadPropagatedFrom PropagatesStopTo StopPropagatedFrom
+	JoinsNamespaceOf RequiresMountsFor WantsMountsFor OnFailureJobMode OnFailureIsolate OnSuccessJobMode
+	IgnoreOnIsolate StopWhenUnneeded RefuseManualStart RefuseManualStop AllowIsolate DefaultDependencies
+	SurviveFinalKillSignal CollectMode FailureAction SuccessAction FailureActionExitStatus
+	SuccessActionExitStatus JobTimeoutSec JobRunningTimeoutSec JobTimeoutAction JobTimeoutRebootArgument
+	StartLimitIntervalSec StartLimitInterval StartLimitBurst StartLimitAction RebootArgument SourcePath`),
+	conditions("Condition"), conditions("Assert"))
+
+var installKeys = keys(strings.Fields(`Alias WantedBy RequiredBy UpheldBy Also DefaultInstance`))
+
+var serviceKeys = strings.Fields(`
+	Type ExitType RemainAfterExit GuessMainPID PIDFile BusName ExecStart ExecStartPre ExecStartPost ExecCondition
+	ExecReload ExecStop ExecStopPost RestartSec RestartSteps RestartMaxDelaySec TimeoutStartSec TimeoutStopSec
+	TimeoutAbortSec TimeoutSec TimeoutStartFailureMode TimeoutStopFailureMode RuntimeMaxSec
+	RuntimeRandomizedExtraSec WatchdogSec Restart RestartMode SuccessExitStatus RestartPreventExitStatus
+	RestartForceExitStatus RootDirectoryStartOnly NonBlocking NotifyAccess Sockets FileDescriptorStoreMax
+	FileDescriptorStorePreserve USBFunctionDescriptors USBFunctionStrings OOMPolicy OpenFile ReloadSignal
+	PermissionsStartOnly StartLimitInterval StartLimitBurst StartLimitAction FailureAction RebootArgument`)
+
+var socketKeys = strings.Fields(`
+	ListenStream ListenDatagram ListenSequentialPacket ListenFIFO ListenSpecial ListenNetlink ListenMessageQueue
+	ListenUSBFunction SocketProtocol BindIPv6Only Backlog BindToDevice SocketUser SocketGroup DirectoryMode
+	SocketMode Accept Writable FlushPending MaxConnections MaxConnectionsPerSource KeepAlive KeepAliveTimeSec
+	KeepAliveIntervalSec KeepAliveProbes NoDelay Priority DeferAcceptSec ReceiveBuffer SendBuffer IPTOS IPTTL
+	Mark ReusePort SmackLabel SmackLabelIPIn SmackLabelIPOut SELinuxContextFromNet PipeSize
+	MessageQueueMaxMessages MessageQueueMessageSize FreeBind Transparent Broadcast PassCredentials PassSecurity
+	PassPacketInfo Timestamping TCPCongestion ExecStartPre ExecStartPost ExecStopPre ExecStopPost TimeoutSec
+	Service RemoveOnStop Symlinks FileDescriptorName TriggerLimitIntervalSec TriggerLimitBurst
+	PollLimitIntervalSec PollLimitBurst`)
+
+var mountKeys = strings.Fields(`
+	What Where Type Options SloppyOptions LazyUnmount ReadWriteOnly ForceUnmount DirectoryMode TimeoutSec`)
+
+var automountKeys = strings.Fields(`Where ExtraOptions DirectoryMode TimeoutIdleSec`)
+
+var timerKeys = strings.Fields(`
+	OnActiveSec OnBootSec OnStartupSec OnUnitActiveSec OnUnitInactiveSec OnCalendar OnClockChange
+	OnTimezoneChange AccuracySec RandomizedDelaySec RandomizedOffsetSec FixedRandomDelay DeferReactivation Unit
+	Persistent WakeSystem RemainAfterElapse`)
+
+var pathKeys = strings.Fields(`
+	PathExists PathExistsGlob PathChanged PathModified DirectoryNotEmpty Unit MakeDirectory DirectoryMode
+	TriggerLimitIntervalSec TriggerLimitBurst`)
+
+// execKeys are the execution environment directives of systemd.exec(5).
+var execKeys = strings.Fields(`
+	WorkingDirectory RootDirectory RootImage RootImageOptions RootEphemeral RootHash RootHashSignature RootVerity
+	RootImagePolicy MountImagePolicy ExtensionImagePolicy MountAPIVFS ProtectProc ProcSubset BindPaths
+	BindReadOnlyPaths MountImages ExtensionImages ExtensionDirectories User Group DynamicUser SupplementaryGroups
+	SetLoginEnvironment PAMName CapabilityBoundingSet AmbientCapabilities NoNewPrivileges SecureBits
+	SELinuxContext AppArmorProfile SmackProcessLabel LimitCPU LimitFSIZE LimitDATA LimitSTACK LimitCORE LimitRSS
+	LimitNOFILE LimitAS LimitNPROC LimitMEMLOCK LimitLOCKS LimitSIGPENDING LimitMSGQUEUE LimitNICE LimitRTPRIO
+	LimitRTTIME UMask CoredumpFilter KeyringMode OOMScoreAdjust TimerSlackNSec Personality IgnoreSIGPIPE Nice
+	CPUSchedulingPolicy CPUSchedulingPriority CPUSchedulingResetOnFork CPUAffinity NUMAPolicy NUMAMask
+	IOSchedulingClass IOSchedulingPriority ProtectSystem ProtectHome RuntimeDirectory StateDirectory
+	CacheDirectory LogsDirectory ConfigurationDirectory RuntimeDirectoryMode StateDirectoryMode
+	CacheDirectoryMode LogsDirectoryMode ConfigurationDirectoryMode RuntimeDirectoryPreserve TimeoutCleanSec
+	ReadWritePaths ReadOnlyPaths InaccessiblePaths ExecPaths NoExecPaths TemporaryFileSystem PrivateTmp
+	PrivateDevices PrivateNetwork NetworkNamespacePath PrivateIPC IPCNamespacePath MemoryKSM PrivateUsers
+	ProtectHostname ProtectClock ProtectKernelTunables ProtectKernelModules ProtectKernelLogs
+	ProtectControlGroups RestrictAddressFamilies RestrictFileSystems RestrictNamespaces LockPersonality
+	MemoryDenyWriteExecute RestrictRealtime RestrictSUIDSGID RemoveIPC PrivateMounts MountFlags
+	SystemCallFilter SystemCallErrorNumber SystemCallArchitectures SystemCallLog Environment EnvironmentFile
+	PassEnvironment UnsetEnvironment StandardInput StandardOutput StandardError StandardInputText
+	StandardInputData LogLevelMax LogExtraFields LogRateLimitIntervalSec LogRateLimitBurst LogFilterPatterns
+	LogNamespace SyslogIdentifier SyslogFacility SyslogLevel SyslogLevelPrefix TTYPath TTYReset TTYVHangup
+	TTYRows TTYColumns TTYVTDisallocate LoadCredential LoadCredentialEncrypted ImportCredential SetCredential
+	SetCredentialEncrypted UtmpIdentifier UtmpMode ReadOnlyDirectories ReadWriteDirectories
+	InaccessibleDirectories`)
+
+// killKeys are the process killing directives of systemd.kill(5).
+var killKeys = strings.Fields(`
+	KillMode KillSignal RestartKillSignal SendSIGHUP SendSIGKILL FinalKillSignal WatchdogSignal`)
+
+// resourceKeys are the resource control directives of systemd.resource-control(5).
+var resourceKeys = strings.Fields(`
+	CPUAccounting CPUWeight StartupCPUWeight CPUQuota CPUQuotaPeriodSec AllowedCPUs StartupAllowedCPUs
+	AllowedMemoryNodes StartupAllowedMemoryNodes MemoryAccounting MemoryMin MemoryLow StartupMemoryLow
+	DefaultStartupMemoryLow MemoryHigh StartupMemoryHigh MemoryMax StartupMemoryMax MemorySwapMax
+	StartupMemorySwapMax MemoryZSwapMax StartupMemoryZSwapMax MemoryZSwapWriteback TasksAccounting TasksMax
+	IOAccounting IOWeight StartupIOWeight IODeviceWeight IOReadBandwidthMax IOWriteBandwidthMax IOReadIOPSMax
+	IOWriteIOPSMax IODeviceLatencyTargetSec IPAccounting IPAddressAllow IPAddressDeny SocketBindAllow
+	SocketBindDeny RestrictNetworkInterfaces NFTSet IPIngressFilterPath IPEgressFilterPath BPFProgram
+	DeviceAllow DevicePolicy Slice Delegate DelegateSubgroup DisableControllers ManagedOOMSwap
+	ManagedOOMMemoryPressure ManagedOOMMemoryPressureLimit ManagedOOMPreference MemoryPressureWatch
+	MemoryPressureThresholdSec CoredumpReceive CPUShares StartupCPUShares MemoryLimit BlockIOAccounting
+	BlockIOWeight StartupBlockIOWeight BlockIODeviceWeight BlockIOReadBandwidth BlockIOWriteBandwidth`)
+
+// Conditions returns the Condition or Assert keys depending on prefix.
+func conditions(prefix string) []string {
+	names := strings.Fields(`
+		Architecture Firmware Virtualization Host KernelCommandLine KernelVersion Version Environment Security
+		Capability ACPower NeedsUpdate FirstBoot PathExists PathExistsGlob PathIsDirectory PathIsSymbolicLink
+		PathIsMountPoint PathIsReadWrite PathIsEncrypted DirectoryNotEmpty FileNotEmpty FileIsExecutable User
+		Group ControlGroupController Memory CPUs CPUFeature OSRelease MemoryPressure CPUPressure IOPressure
+		Credential`)
+	result := make([]string, len(names))
+	for i, n := range names {
+		result[i] = prefix + n
+	}
+	return result
+}
+
+// Keys returns a set of the keys in lists.
+func keys(lists ...[]string) map[string]bool {
+	m := make(map[string]bool)
+	for _, l := range lists {
+		for _, k := range l {
+			m[k] = true
+		}
+	}
+	return m
+}
@@ -0,0 +1,179 @@
+// Package unitfile parses and validates systemd unit files.
+//
+// The syntax is the one described in systemd.syntax(7); sections, key=value assignments, comments, line continuations
+// and % specifiers. Each assignment is kept, a key that's assigned more than once (like ExecStartPre or Environment)
+// results in multiple Options.
+package unitfile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// File is a parsed unit file.
+type File struct {
+	Sections []*Section
+}
+
+// Section is a [Name] section of a unit file.
+type Section struct {
+	Name string
+	// Line is the line number of the section header.
+	Line    int
+	Options []*Option
+}
+
+// Option is a Name=Value assignment in a section.
+type Option struct {
+	Name  string
+	Value string
+	// Line is the line number on which the assignment starts.
+	Line int
+}
+
+// Error is a syntax or validation error at a line of a unit file.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Errors is a list of Error.
+type Errors []*Error
+
+func (es Errors) Error() string {
+	s := make([]string, len(es))
+	for i, e := range es {
+		s[i] = e.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// Parse reads a unit file.
+// It returns Errors when the content isn't valid unit file syntax.
+func Parse(r io.Reader) (*File, error) {
+	f := &File{}
+	var errs Errors
+	var section *Section
+
+	sc := bufio.NewScanner(r)
+	var ln int
+	for sc.Scan() {
+		ln++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || isComment(line) {
+			continue
+		}
+
+		// join continuation lines, comments in between are ignored
+		start := ln
+		for strings.HasSuffix(line, "\\") && sc.Scan() {
+			ln++
+			next := strings.TrimSpace(sc.Text())
+			if isComment(next) {
+				continue
+			}
+			line = strings.TrimSuffix(line, "\\") + " " + next
+		}
+		line = strings.TrimSuffix(line, "\\")
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || len(line) < 3 {
+				errs = append(errs, &Error{start, fmt.Sprintf("invalid section header %q", line)})
+				section = nil
+				continue
+			}
+			section = &Section{Name: line[1 : len(line)-1], Line: start}
+			f.Sections = append(f.Sections, section)
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			errs = append(errs, &Error{start, fmt.Sprintf("missing '=' in %q", line)})
+			continue
+		}
+		name := strings.TrimSpace(line[:i])
+		if name == "" {
+			errs = append(errs, &Error{start, "missing key"})
+			continue
+		}
+		if section == nil {
+			errs = append(errs, &Error{start, fmt.Sprintf("assignment of %s outside of a section", name)})
+			continue
+		}
+		section.Options = append(section.Options, &Option{
+			Name:  name,
+			Value: strings.TrimSpace(line[i+1:]),
+			Line:  start,
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(errs) > 0 {
+		return f, errs
+	}
+	return f, nil
+}
+
+// Section returns the options of all sections with name, systemd merges sections with the same name.
+// It returns nil when there is no such section.
+func (f *File) Section(name string) *Section {
+	var result *Section
+	for _, s := range f.Sections {
+		if s.Name != name {
+			continue
+		}
+		if result == nil {
+			result = &Section{Name: s.Name, Line: s.Line}
+		}
+		result.Options = append(result.Options, s.Options...)
+	}
+	return result
+}
+
+// Values returns the values assigned to key name.
+// An empty assignment resets the list, like systemd does for list options.
+func (s *Section) Values(name string) []string {
+	var result []string
+	for _, o := range s.Options {
+		if o.Name != name {
+			continue
+		}
+		if o.Value == "" {
+			result = nil
+			continue
+		}
+		result = append(result, o.Value)
+	}
+	return result
+}
+
+// Specifiers returns the % specifiers used in value, for example 'n' and 'i' for '/run/%n/%i'.
+// An escaped percent sign (%%) is returned as '%'.
+// It returns an error when value ends with a single %.
+func Specifiers(value string) ([]byte, error) {
+	var result []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' {
+			continue
+		}
+		i++
+		if i == len(value) {
+			return result, fmt.Errorf("incomplete specifier at end of %q", value)
+		}
+		result = append(result, value[i])
+	}
+	return result, nil
+}
+
+func isComment(line string) bool {
+	return strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";")
+}
@@ -0,0 +1,167 @@
+package unitfile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Option is the name, value and line of an Option for comparison.
+type option struct {
+	section, name, value string
+	line                 int
+}
+
+func options(f *File) []option {
+	var result []option
+	for _, s := range f.Sections {
+		for _, o := range s.Options {
+			result = append(result, option{s.Name, o.Name, o.Value, o.Line})
+		}
+	}
+	return result
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []option
+		wantErr string
+	}{
+		{
+			name:    "sections and comments",
+			content: "# comment\n[Unit]\nDescription = test \n; comment\n\n[Service]\nExecStart=/bin/true\n",
+			want: []option{
+				{"Unit", "Description", "test", 3},
+				{"Service", "ExecStart", "/bin/true", 7},
+			},
+		},
+		{
+			name:    "repeated keys",
+			content: "[Service]\nEnvironment=A=1\nEnvironment=B=2\nExecStartPre=/bin/a\nExecStartPre=/bin/b\n",
+			want: []option{
+				{"Service", "Environment", "A=1", 2},
+				{"Service", "Environment", "B=2", 3},
+				{"Service", "ExecStartPre", "/bin/a", 4},
+				{"Service", "ExecStartPre", "/bin/b", 5},
+			},
+		},
+		{
+			name:    "line continuation",
+			content: "[Service]\nExecStart=/bin/echo \\\n  a \\\n# comment\n  b\nType=oneshot\n",
+			want: []option{
+				{"Service", "ExecStart", "/bin/echo  a  b", 2},
+				{"Service", "Type", "oneshot", 6},
+			},
+		},
+		{
+			name:    "continuation at end of file",
+			content: "[Service]\nExecStart=/bin/true \\",
+			want: []option{
+				{"Service", "ExecStart", "/bin/true", 2},
+			},
+		},
+		{
+			name:    "empty value",
+			content: "[Service]\nExecStart=\n",
+			want: []option{
+				{"Service", "ExecStart", "", 2},
+			},
+		},
+		{
+			name:    "assignment outside of a section",
+			content: "Description=test\n[Unit]\n",
+			wantErr: "line 1: assignment of Description outside of a section",
+		},
+		{
+			name:    "invalid section header",
+			content: "[Unit]\nDescription=test\n[Service\nExecStart=/bin/true\n",
+			wantErr: `line 3: invalid section header "[Service"; line 4: assignment of ExecStart outside of a section`,
+		},
+		{
+			name:    "missing key and missing =",
+			content: "[Unit]\n\n=test\nDescription\n",
+			wantErr: `line 3: missing key; line 4: missing '=' in "Description"`,
+		},
+		{
+			name:    "error line is the start of a continuation",
+			content: "[Unit]\nDescription \\\ntest\n",
+			wantErr: `line 2: missing '=' in "Description  test"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := Parse(strings.NewReader(tt.content))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("Parse() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got := options(f); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValues(t *testing.T) {
+	content := "[Service]\nExecStartPre=/bin/a\n[Unit]\nDescription=test\n[Service]\nExecStartPre=/bin/b\n" +
+		"Environment=A=1\nEnvironment=\nEnvironment=B=2\nExecStop=/bin/c\nExecStop=\n"
+	f, err := Parse(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := f.Section("Install"); s != nil {
+		t.Errorf("Section(Install) = %v, want nil", s)
+	}
+	s := f.Section("Service")
+	if s.Line != 1 {
+		t.Errorf("Section(Service).Line = %d, want 1", s.Line)
+	}
+
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		// sections with the same name are merged
+		{"ExecStartPre", []string{"/bin/a", "/bin/b"}},
+		// an empty assignment resets the list
+		{"Environment", []string{"B=2"}},
+		{"ExecStop", nil},
+		{"Type", nil},
+	}
+	for _, tt := range tests {
+		if got := s.Values(tt.key); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Values(%s) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestSpecifiers(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"/bin/true", "", false},
+		{"/run/%n/%i", "ni", false},
+		{"100%%", "%", false},
+		{"%%i", "%", false},
+		{"%", "", true},
+		{"/run/%i%", "i", true},
+	}
+	for _, tt := range tests {
+		got, err := Specifiers(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Specifiers(%q) error = %v, wantErr %t", tt.value, err, tt.wantErr)
+		}
+		if string(got) != tt.want {
+			t.Errorf("Specifiers(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package unitfile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Validate checks that the sections and keys of f are known for unitType (service, timer, etc).
+// Sections and keys starting with 'X-' are extensions and always accepted.
+// For unit types without a known set of directives only the specifiers are checked.
+// It returns Errors for each unknown section, key or specifier.
+func Validate(f *File, unitType string) error {
+	var errs Errors
+
+	sections, known := unitSections[unitType]
+	for _, s := range f.Sections {
+		keys, ok := sections[s.Name]
+		if known && !ok && !strings.HasPrefix(s.Name, "X-") {
+			errs = append(errs, &Error{s.Line, fmt.Sprintf("unknown section [%s] in %s unit", s.Name, unitType)})
+			continue
+		}
+		for _, o := range s.Options {
+			if ok && !keys[o.Name] && !strings.HasPrefix(o.Name, "X-") {
+				errs = append(errs, &Error{o.Line, fmt.Sprintf("unknown key %s in section [%s]", o.Name, s.Name)})
+			}
+			sp, err := Specifiers(o.Value)
+			if err != nil {
+				errs = append(errs, &Error{o.Line, err.Error()})
+			}
+			for _, c := range sp {
+				if !specifiers[c] {
+					errs = append(errs, &Error{o.Line, fmt.Sprintf("unknown specifier %%%c in %s", c, o.Name)})
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+		return errs
+	}
+	return nil
+}
+
+// ParseAndValidate parses content and validates it for unitType.
+func ParseAndValidate(content, unitType string) error {
+	f, err := Parse(strings.NewReader(content))
+	if err != nil {
+		return err
+	}
+	return Validate(f, unitType)
+}
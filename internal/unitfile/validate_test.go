@@ -0,0 +1,80 @@
+package unitfile
+
+import (
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		unitType string
+		content  string
+		wantErr  string
+	}{
+		{
+			name:     "valid service",
+			unitType: "service",
+			content:  "[Unit]\nDescription=%n\n[Service]\nExecStart=/bin/echo %i 100%%\n[Install]\nWantedBy=multi-user.target\n",
+		},
+		{
+			name:     "valid timer",
+			unitType: "timer",
+			content:  "[Timer]\nOnCalendar=hourly\nPersistent=true\n",
+		},
+		{
+			name:     "extensions",
+			unitType: "service",
+			content:  "[X-Vendor]\nAnything=1\n[Service]\nX-Note=1\n",
+		},
+		{
+			name:     "unknown section",
+			unitType: "timer",
+			content:  "[Unit]\nDescription=test\n[Service]\nExecStart=/bin/true\n",
+			wantErr:  "line 3: unknown section [Service] in timer unit",
+		},
+		{
+			name:     "unknown keys sorted by line",
+			unitType: "service",
+			content:  "[Service]\nExecStart=/bin/true\nExecStrat=/bin/true\n[Unit]\nDescripton=test\n",
+			wantErr:  "line 3: unknown key ExecStrat in section [Service]; line 5: unknown key Descripton in section [Unit]",
+		},
+		{
+			name:     "unknown specifier",
+			unitType: "service",
+			content:  "[Service]\nExecStart=/bin/echo %Z\n",
+			wantErr:  "line 2: unknown specifier %Z in ExecStart",
+		},
+		{
+			name:     "incomplete specifier",
+			unitType: "service",
+			content:  "[Service]\nExecStart=/bin/echo 100%\n",
+			wantErr:  `line 2: incomplete specifier at end of "/bin/echo 100%"`,
+		},
+		{
+			name:     "unknown type only checks specifiers",
+			unitType: "slice",
+			content:  "[Slice]\nAnything=%Z\n",
+			wantErr:  "line 2: unknown specifier %Z in Anything",
+		},
+		{
+			name:     "syntax error",
+			unitType: "service",
+			content:  "[Service]\nExecStart\n",
+			wantErr:  `line 2: missing '=' in "ExecStart"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ParseAndValidate(tt.content, tt.unitType)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ParseAndValidate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("ParseAndValidate() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}